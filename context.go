@@ -0,0 +1,33 @@
+package jobqueue
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey struct {
+	name string
+}
+
+// WaitTimeKey is the context key of the wait time. The context of the jobs
+// started with Go contains how long they were waiting in the stack.
+var WaitTimeKey = &contextKey{"wait-time"}
+
+// QueueNameKey is the context key of the queue name. The context of the jobs
+// started with Go contains the Name of the stack executing them.
+var QueueNameKey = &contextKey{"queue-name"}
+
+// WaitTimeFromContext returns how long a job started with Go was waiting in the
+// stack, based on the context received by the job.
+func WaitTimeFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(WaitTimeKey).(time.Duration)
+	return d, ok
+}
+
+// QueueNameFromContext returns the Name of the stack that executes a job
+// started with Go, based on the context received by the job. The name is
+// empty when the Name option was not set.
+func QueueNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(QueueNameKey).(string)
+	return name, ok
+}
@@ -32,10 +32,10 @@ Example
 		for _, j := range jobs {
 			go func(j func()) {
 				err := stack.Do(j)
-				switch err {
-				case jobqueue.ErrStackFull:
+				switch {
+				case errors.Is(err, jobqueue.ErrStackFull):
 					d.inc()
-				case jobqueue.ErrTimeout:
+				case errors.Is(err, jobqueue.ErrTimeout):
 					to.inc()
 				}
 
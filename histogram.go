@@ -0,0 +1,110 @@
+package jobqueue
+
+import "time"
+
+const (
+	outcomeScheduled = iota
+	outcomeDropped
+	outcomeTimedOut
+)
+
+type histogramKey struct {
+	bucket  time.Duration
+	buckets int
+}
+
+// outcomeTracker counts the outcomes of the jobs in a rolling window of time
+// buckets.
+type outcomeTracker struct {
+	bucket  time.Duration
+	counts  [][3]int
+	current int
+	start   time.Time
+}
+
+func newOutcomeTracker(bucket time.Duration, buckets int, now time.Time) *outcomeTracker {
+	return &outcomeTracker{
+		bucket: bucket,
+		counts: make([][3]int, buckets),
+		start:  now,
+	}
+}
+
+// advance moves the window forward, until the current bucket contains now.
+func (t *outcomeTracker) advance(now time.Time) {
+	if now.Sub(t.start) >= time.Duration(len(t.counts))*t.bucket {
+		for i := range t.counts {
+			t.counts[i] = [3]int{}
+		}
+
+		t.start = t.start.Add(now.Sub(t.start) / t.bucket * t.bucket)
+		return
+	}
+
+	for now.Sub(t.start) >= t.bucket {
+		t.current = (t.current + 1) % len(t.counts)
+		t.counts[t.current] = [3]int{}
+		t.start = t.start.Add(t.bucket)
+	}
+}
+
+func (t *outcomeTracker) record(now time.Time, outcome int) {
+	t.advance(now)
+	t.counts[t.current][outcome]++
+}
+
+// snapshot returns the buckets from the oldest to the current one.
+func (t *outcomeTracker) snapshot(now time.Time) [][3]int {
+	t.advance(now)
+	h := make([][3]int, len(t.counts))
+	for i := range h {
+		h[i] = t.counts[(t.current+1+i)%len(t.counts)]
+	}
+
+	return h
+}
+
+func (s *Stack) recordOutcome(outcome int) {
+	if len(s.histograms) == 0 {
+		return
+	}
+
+	now := s.now()
+	for _, t := range s.histograms {
+		t.record(now, outcome)
+	}
+}
+
+// OutcomeHistogram returns the number of the scheduled, the dropped and the
+// timed out jobs, in this order, in each of the last buckets time buckets of
+// the duration bucket, from the oldest to the current one.
+//
+// The stack starts counting the outcomes for a combination of the arguments
+// when OutcomeHistogram is called with them the first time, so the first call
+// returns only zeros. The memory used is bounded by the number of the buckets,
+// for each combination of the arguments. When the stack is closed, or the
+// arguments are not positive, it returns nil.
+func (s *Stack) OutcomeHistogram(bucket time.Duration, buckets int) [][3]int {
+	if bucket <= 0 || buckets <= 0 {
+		return nil
+	}
+
+	var h [][3]int
+	s.call(func() {
+		now := s.now()
+		key := histogramKey{bucket: bucket, buckets: buckets}
+		t, ok := s.histograms[key]
+		if !ok {
+			if s.histograms == nil {
+				s.histograms = make(map[histogramKey]*outcomeTracker)
+			}
+
+			t = newOutcomeTracker(bucket, buckets, now)
+			s.histograms[key] = t
+		}
+
+		h = t.snapshot(now)
+	})
+
+	return h
+}
@@ -0,0 +1,69 @@
+package jobqueue
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOutcomeHistogram(t *testing.T) {
+	c := &testClock{now: time.Now()}
+	q := withClock(Options{}, c.get)
+	defer q.CloseForced()
+
+	if h := q.OutcomeHistogram(time.Minute, 3); !reflect.DeepEqual(h, make([][3]int, 3)) {
+		t.Fatal("unexpected outcomes", h)
+	}
+
+	if _, err := q.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.advance(time.Minute)
+	if err := q.ReconfigureSync(Options{Timeout: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Wait(); !errors.Is(err, ErrTimeout) {
+		t.Fatal("failed to time out", err)
+	}
+
+	c.advance(time.Minute)
+	if err := q.ReconfigureSync(Options{MaxStackSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		go q.Wait()
+	}
+
+	expected := [][3]int{{1, 0, 0}, {0, 0, 1}, {0, 1, 0}}
+	for {
+		h := q.OutcomeHistogram(time.Minute, 3)
+		if h[2][1] == 0 {
+			continue
+		}
+
+		if !reflect.DeepEqual(h, expected) {
+			t.Fatal("invalid outcomes", h)
+		}
+
+		break
+	}
+
+	c.advance(time.Minute)
+	expected = [][3]int{{0, 0, 1}, {0, 1, 0}, {0, 0, 0}}
+	if h := q.OutcomeHistogram(time.Minute, 3); !reflect.DeepEqual(h, expected) {
+		t.Error("failed to roll the window", h)
+	}
+
+	c.advance(10 * time.Minute)
+	if h := q.OutcomeHistogram(time.Minute, 3); !reflect.DeepEqual(h, make([][3]int, 3)) {
+		t.Error("failed to reset the window", h)
+	}
+
+	if h := q.OutcomeHistogram(0, 3); h != nil {
+		t.Error("unexpected outcomes for invalid arguments", h)
+	}
+}
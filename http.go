@@ -1,10 +1,27 @@
 package jobqueue
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
 
 type nop404 struct{}
 
+// defaultMaxLabels is the default limit of the labels tracked by LabelStats.
+const defaultMaxLabels = 1024
+
 // HTTPOptions extends the main stack options with the HTTP related configuration.
+//
+// By default, the stack schedules the requests in LIFO order, which maximizes the
+// number of the requests served while their clients are still waiting, but under a
+// sustained load, the early arriving requests may wait until they time out, causing
+// high tail latency. Setting ScheduleOrder to ScheduleFIFO bounds the wait time of
+// every request by the queue length, at the cost of also serving the requests
+// whose clients may have given up already.
 type HTTPOptions struct {
 
 	// Options contains the common options for the stack.
@@ -17,15 +34,81 @@ type HTTPOptions struct {
 
 	// TimeoutStatusCode is used when a job times out before its processing
 	// has been started. Defaults to 503 Service Unavailable.
+	//
+	// The requests rejected for any other reason, e.g. by the circuit breaker,
+	// by the Admit option of the stack, or because it was closed, receive 503
+	// Service Unavailable.
 	TimeoutStatusCode int
+
+	// OnComplete, when set, is called after the stack granted a slot to the
+	// request, but before the wrapped handler is invoked. The waited argument
+	// contains how long the request was waiting in the stack.
+	//
+	// It can be used to set response headers that need to be present
+	// regardless of the wrapped handler. Since it is called before the
+	// wrapped handler, it must not call WriteHeader or Write, otherwise the
+	// headers set by the wrapped handler are ignored.
+	OnComplete func(w http.ResponseWriter, r *http.Request, waited time.Duration)
+
+	// DefaultHandler, when set, is used instead of the wrapped handler, when
+	// the wrapped handler is nil, e.g. to respond with a custom body or status
+	// code. Defaults to a handler responding with 404 Not Found.
+	DefaultHandler http.Handler
+
+	// ServerTiming, when set, makes the handler add a Server-Timing header to
+	// the requests that were granted a slot, containing how long the request
+	// was waiting in the stack, in milliseconds, e.g. queue;dur=12.345. Since
+	// the header is set before the wrapped handler is invoked, it doesn't
+	// include the duration of the handler.
+	ServerTiming bool
+
+	// LabelFunc, when set, returns the label of a request, used to count the
+	// outcomes of the requests by label, see LabelStats. Defaults to the path
+	// of the request URL.
+	LabelFunc func(r *http.Request) string
+
+	// MaxLabels limits how many different labels are tracked by LabelStats.
+	// The requests with further labels are counted under the empty label.
+	// Defaults to 1024.
+	MaxLabels int
+
+	// OnServed, when set, is called after every request, both served and
+	// rejected by the stack, with how long the request was waiting in the
+	// stack, and whether it was rejected. For the rejected requests, the
+	// queueWait argument contains how long it took to reject them. It is
+	// called after the response was written by the wrapped handler.
+	OnServed func(r *http.Request, queueWait time.Duration, shed bool)
+
+	// WeightFunc, when set, returns the scheduling weight of a request, e.g.
+	// based on a header identifying the tier of the client. The requests with
+	// a higher weight get a proportionally larger share of the free slots, and
+	// when the stack is full, the oldest request of the lowest weight is
+	// dropped. Unless the Scheduler option of the stack is set, the handlers
+	// creating their own stack use the WeightedFair scheduler. The stack
+	// passed in to NewHandlerWithStack needs to be created with a scheduler
+	// using the weights, otherwise the weights have no effect.
+	WeightFunc func(r *http.Request) int
+
+	// NoQueue, when set, makes the handler serve only the requests that can
+	// be started immediately, and respond to the rest with the
+	// StackFullStatusCode without waiting, see TryDo.
+	NoQueue bool
 }
 
 // Handler is wrapper around Stack that implements the standard http.Handler
 // interface.
 type Handler struct {
-	options HTTPOptions
-	handler http.Handler
-	stack   *Stack
+	options   HTTPOptions
+	mx        sync.RWMutex
+	handler   http.Handler
+	stack     *Stack
+	ownsStack bool
+	labelsMx  sync.Mutex
+	labels    map[string][3]int
+
+	inflightMx sync.Mutex
+	inflight   map[*http.Request]context.CancelFunc
+	drained    chan struct{}
 }
 
 func (nop404) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
@@ -40,9 +123,66 @@ func (nop404) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
 // Instances of the Handler needs to be closed with the Close method once
 // they are not used anymore.
 func NewHandler(o HTTPOptions, h http.Handler) *Handler {
-	s := With(o.Options)
+	handler := newHandler(o, With(stackOptions(o)), h)
+	handler.ownsStack = true
+	return handler
+}
+
+// NewHandlerWithStack initializes a Handler that uses an existing stack,
+// instead of creating its own. This way multiple handlers can share the same
+// concurrency limits. The Options field of the HTTPOptions argument is
+// ignored.
+//
+// The stack is owned by the caller: closing the Handler doesn't close the
+// stack, it needs to be closed separately once all the handlers using it are
+// not used anymore.
+func NewHandlerWithStack(o HTTPOptions, s *Stack, h http.Handler) *Handler {
+	return newHandler(o, s, h)
+}
+
+// Middleware returns a function that wraps an http.Handler with a throttling
+// Handler, compatible with the common router middleware signature. All the
+// handlers wrapped by the same middleware share a single underlying stack,
+// which is created when the middleware is applied first. The shared stack is
+// meant to live as long as the process, and it is never closed. When the stack
+// needs to be closed, use MiddlewareWithStack.
+func Middleware(o HTTPOptions) func(http.Handler) http.Handler {
+	var (
+		once sync.Once
+		s    *Stack
+	)
+
+	return func(h http.Handler) http.Handler {
+		once.Do(func() { s = With(stackOptions(o)) })
+		return newHandler(o, s, h)
+	}
+}
+
+// MiddlewareWithStack is like Middleware, but the wrapped handlers share an
+// existing stack, the same way as with NewHandlerWithStack. The Options field
+// of the HTTPOptions argument is ignored. The stack is owned by the caller,
+// and it needs to be closed separately.
+func MiddlewareWithStack(o HTTPOptions, s *Stack) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return NewHandlerWithStack(o, s, h)
+	}
+}
+
+func stackOptions(o HTTPOptions) Options {
+	if o.WeightFunc != nil && o.Scheduler == nil {
+		o.Scheduler = &WeightedFair{}
+	}
+
+	return o.Options
+}
+
+func newHandler(o HTTPOptions, s *Stack, h http.Handler) *Handler {
+	if o.DefaultHandler == nil {
+		o.DefaultHandler = nop404{}
+	}
+
 	if h == nil {
-		h = nop404{}
+		h = o.DefaultHandler
 	}
 
 	if o.StackFullStatusCode == 0 {
@@ -53,24 +193,221 @@ func NewHandler(o HTTPOptions, h http.Handler) *Handler {
 		o.TimeoutStatusCode = http.StatusServiceUnavailable
 	}
 
-	return &Handler{options: o, stack: s, handler: h}
+	if o.LabelFunc == nil {
+		o.LabelFunc = func(r *http.Request) string { return r.URL.Path }
+	}
+
+	if o.MaxLabels <= 0 {
+		o.MaxLabels = defaultMaxLabels
+	}
+
+	return &Handler{
+		options:  o,
+		stack:    s,
+		handler:  h,
+		labels:   make(map[string][3]int),
+		inflight: make(map[*http.Request]context.CancelFunc),
+	}
+}
+
+// StatusCodeForError returns the HTTP status code that the Handler responds
+// with, when the stack returns err, based on the StackFullStatusCode and the
+// TimeoutStatusCode options, or their defaults. It can be used by custom
+// handlers to map the errors consistently. It returns 200 OK for nil, and 503
+// Service Unavailable for the errors without a dedicated status code, e.g.
+// ErrClosed.
+func StatusCodeForError(err error, o HTTPOptions) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrStackFull):
+		if o.StackFullStatusCode == 0 {
+			return http.StatusServiceUnavailable
+		}
+
+		return o.StackFullStatusCode
+	case errors.Is(err, ErrTimeout):
+		if o.TimeoutStatusCode == 0 {
+			return http.StatusServiceUnavailable
+		}
+
+		return o.TimeoutStatusCode
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+func serverTiming(waited time.Duration) string {
+	return fmt.Sprintf("queue;dur=%.3f", float64(waited)/float64(time.Millisecond))
+}
+
+// countLabel records the outcome of a request by its label.
+func (h *Handler) countLabel(r *http.Request, err error) {
+	var outcome int
+	switch {
+	case err == nil:
+		outcome = outcomeScheduled
+	case errors.Is(err, ErrStackFull):
+		outcome = outcomeDropped
+	case errors.Is(err, ErrTimeout):
+		outcome = outcomeTimedOut
+	default:
+		return
+	}
+
+	label := h.options.LabelFunc(r)
+	h.labelsMx.Lock()
+	defer h.labelsMx.Unlock()
+	if _, ok := h.labels[label]; !ok && len(h.labels) >= h.options.MaxLabels {
+		label = ""
+	}
+
+	c := h.labels[label]
+	c[outcome]++
+	h.labels[label] = c
+}
+
+// LabelStats returns the number of the accepted, dropped and timed out
+// requests, in this order, by the label of the requests, see the LabelFunc
+// option. It helps to find which requests are affected by the load.
+func (h *Handler) LabelStats() map[string][3]int {
+	h.labelsMx.Lock()
+	defer h.labelsMx.Unlock()
+	s := make(map[string][3]int, len(h.labels))
+	for l, c := range h.labels {
+		s[l] = c
+	}
+
+	return s
+}
+
+func (h *Handler) currentHandler() http.Handler {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+	return h.handler
+}
+
+// SetHandler replaces the wrapped handler. The requests already being
+// processed are finished by the previous handler, while the new requests are
+// served by the new one. When handler is nil, the Handler uses the
+// DefaultHandler option, by default responding with 404 Not Found.
+func (h *Handler) SetHandler(handler http.Handler) {
+	if handler == nil {
+		handler = h.options.DefaultHandler
+	}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.handler = handler
+}
+
+// track registers a request being processed, and returns it with a context
+// that can be canceled by Shutdown.
+func (h *Handler) track(r *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(ctx)
+	h.inflightMx.Lock()
+	defer h.inflightMx.Unlock()
+	h.inflight[r] = cancel
+	return r, func() {
+		h.inflightMx.Lock()
+		defer h.inflightMx.Unlock()
+		delete(h.inflight, r)
+		cancel()
+		if h.drained != nil && len(h.inflight) == 0 {
+			close(h.drained)
+			h.drained = nil
+		}
+	}
 }
 
 // ServeHTTP implements the http.Handler interface.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	err := h.stack.Do(func() {
-		h.handler.ServeHTTP(w, r)
+	r, finish := h.track(r)
+	defer finish()
+	start := time.Now()
+	do := h.stack.Do
+	if h.options.NoQueue {
+		do = h.stack.TryDo
+	} else if h.options.WeightFunc != nil {
+		weight := h.options.WeightFunc(r)
+		do = func(job func()) error {
+			done, err := h.stack.WaitWeight(weight)
+			if err != nil {
+				return err
+			}
+
+			job()
+			done()
+			return nil
+		}
+	}
+
+	var waited time.Duration
+	err := do(func() {
+		waited = time.Since(start)
+		if h.options.ServerTiming {
+			w.Header().Add("Server-Timing", serverTiming(waited))
+		}
+
+		if h.options.OnComplete != nil {
+			h.options.OnComplete(w, r, waited)
+		}
+
+		h.currentHandler().ServeHTTP(w, r)
 	})
 
-	switch err {
-	case ErrStackFull:
-		w.WriteHeader(h.options.StackFullStatusCode)
-	case ErrTimeout:
-		w.WriteHeader(h.options.TimeoutStatusCode)
+	h.countLabel(r, err)
+	if err != nil {
+		waited = time.Since(start)
+		w.WriteHeader(StatusCodeForError(err, h.options))
+	}
+
+	if h.options.OnServed != nil {
+		h.options.OnServed(r, waited, err != nil)
 	}
 }
 
-// Close frees up the resources used by a Handler instance.
+// Shutdown closes the Handler the same way as Close, and waits until the
+// requests being processed, or waiting in the stack, are finished. If the
+// context is canceled before, it cancels the context of the requests still
+// being processed, and returns the error of the context, e.g. to abort the
+// requests exceeding a grace period. Only the wrapped handlers that observe
+// the context of the request are affected by the cancellation, Shutdown
+// doesn't wait for the rest of them.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.Close()
+	h.inflightMx.Lock()
+	if len(h.inflight) == 0 {
+		h.inflightMx.Unlock()
+		return nil
+	}
+
+	if h.drained == nil {
+		h.drained = make(chan struct{})
+	}
+
+	drained := h.drained
+	h.inflightMx.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		h.inflightMx.Lock()
+		defer h.inflightMx.Unlock()
+		for _, cancel := range h.inflight {
+			cancel()
+		}
+
+		return ctx.Err()
+	}
+}
+
+// Close frees up the resources used by a Handler instance. When the Handler
+// was created with a shared stack, the stack is not closed.
 func (h *Handler) Close() {
-	h.stack.Close()
+	if h.ownsStack {
+		h.stack.Close()
+	}
 }
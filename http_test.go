@@ -1,9 +1,14 @@
 package jobqueue
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -94,6 +99,288 @@ func TestNop404Handler(t *testing.T) {
 	}
 }
 
+func TestDefaultHandler(t *testing.T) {
+	s := testServer(HTTPOptions{
+		DefaultHandler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not configured"))
+		}),
+	}, nil)
+
+	defer s.close()
+	if c, b := mustGet(t, s.url); c != http.StatusServiceUnavailable || b != "not configured" {
+		t.Error("failed to use the default handler", c, b)
+	}
+
+	s.handler.SetHandler(&testHandler{})
+	if c, _ := mustGet(t, s.url); c != http.StatusOK {
+		t.Error("unexpected status code", c, "expected", http.StatusOK)
+	}
+
+	s.handler.SetHandler(nil)
+	if c, _ := mustGet(t, s.url); c != http.StatusServiceUnavailable {
+		t.Error("failed to use the default handler", c)
+	}
+}
+
+func TestCircuitOpenStatus(t *testing.T) {
+	s := testServer(HTTPOptions{Options: Options{Breaker: Breaker{Threshold: 1, Cooldown: time.Hour}}}, &testHandler{})
+	defer s.close()
+	s.handler.stack.call(func() { s.handler.stack.openBreaker(time.Now()) })
+	if c, _ := mustGet(t, s.url); c != http.StatusServiceUnavailable {
+		t.Error("unexpected status code", c, "expected", http.StatusServiceUnavailable)
+	}
+}
+
+func TestAdmissionDeniedStatus(t *testing.T) {
+	s := testServer(HTTPOptions{Options: Options{
+		Admit: func(interface{}, Status) bool { return false },
+	}}, &testHandler{})
+
+	defer s.close()
+	done, err := s.handler.stack.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer done()
+	if c, _ := mustGet(t, s.url); c != http.StatusServiceUnavailable {
+		t.Error("unexpected status code", c, "expected", http.StatusServiceUnavailable)
+	}
+}
+
+func TestNoQueue(t *testing.T) {
+	s := testServer(HTTPOptions{StackFullStatusCode: http.StatusTooManyRequests, NoQueue: true}, &testHandler{})
+	defer s.close()
+	if c, _ := mustGet(t, s.url); c != http.StatusOK {
+		t.Fatal("failed to serve", c)
+	}
+
+	done, err := s.handler.stack.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer done()
+	start := time.Now()
+	if c, _ := mustGet(t, s.url); c != http.StatusTooManyRequests {
+		t.Error("failed to shed", c)
+	}
+
+	if d := time.Since(start); d > 120*time.Millisecond {
+		t.Error("shedding took too long", d)
+	}
+
+	if v := s.handler.stack.View(); v.QueuedJobs != 0 || v.Dropped != 1 {
+		t.Error("unexpected queueing", v.QueuedJobs, v.Dropped)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("finished within the grace period", func(t *testing.T) {
+		s := testServer(HTTPOptions{}, &testHandler{})
+		defer s.close()
+		result := make(chan int)
+		go func() {
+			c, _ := mustGetSlow(t, s.url, 15*time.Millisecond)
+			result <- c
+		}()
+
+		for s.handler.stack.Status().ActiveJobs != 1 {
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+		defer cancel()
+		if err := s.handler.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+
+		if c := <-result; c != http.StatusOK {
+			t.Error("failed to finish the request", c)
+		}
+	})
+
+	t.Run("canceled after the grace period", func(t *testing.T) {
+		canceled := make(chan struct{})
+		s := testServer(HTTPOptions{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				close(canceled)
+			case <-time.After(time.Second):
+			}
+		}))
+
+		defer s.close()
+		go http.Get(s.url)
+		for s.handler.stack.Status().ActiveJobs != 1 {
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Millisecond)
+		defer cancel()
+		if err := s.handler.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Error("failed to time out", err)
+		}
+
+		select {
+		case <-canceled:
+		case <-time.After(120 * time.Millisecond):
+			t.Error("failed to cancel the request")
+		}
+	})
+}
+
+func TestWeightFunc(t *testing.T) {
+	var (
+		mx    sync.Mutex
+		order []string
+	)
+
+	s := testServer(HTTPOptions{
+		WeightFunc: func(r *http.Request) int {
+			if r.Header.Get("X-Tier") == "premium" {
+				return 3
+			}
+
+			return 1
+		},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		order = append(order, r.Header.Get("X-Tier"))
+	}))
+
+	defer s.close()
+	done, err := s.handler.stack.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		tier := "basic"
+		if i%2 == 0 {
+			tier = "premium"
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", s.url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			req.Header.Set("X-Tier", tier)
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			rsp.Body.Close()
+		}()
+	}
+
+	for s.handler.stack.Status().QueuedJobs != 16 {
+	}
+
+	done()
+	wg.Wait()
+	var premium int
+	for _, tier := range order[:8] {
+		if tier == "premium" {
+			premium++
+		}
+	}
+
+	if premium <= 4 {
+		t.Error("failed to prefer the premium tier", order)
+	}
+}
+
+func TestStatusCodeForError(t *testing.T) {
+	custom := HTTPOptions{StackFullStatusCode: 429, TimeoutStatusCode: 504}
+	for _, test := range []struct {
+		err      error
+		options  HTTPOptions
+		expected int
+	}{
+		{nil, HTTPOptions{}, http.StatusOK},
+		{ErrStackFull, HTTPOptions{}, http.StatusServiceUnavailable},
+		{ErrStackFull, custom, 429},
+		{ErrEvictedByReconfigure, custom, 429},
+		{ErrTimeout, HTTPOptions{}, http.StatusServiceUnavailable},
+		{&TimeoutError{Waited: time.Millisecond}, custom, 504},
+		{&Error{Name: "foo", Err: ErrTimeout}, custom, 504},
+		{ErrCircuitOpen, custom, http.StatusServiceUnavailable},
+		{ErrAdmissionDenied, custom, http.StatusServiceUnavailable},
+		{ErrBacklogTooDeep, custom, http.StatusServiceUnavailable},
+		{ErrClosed, custom, http.StatusServiceUnavailable},
+	} {
+		if code := StatusCodeForError(test.err, test.options); code != test.expected {
+			t.Error("invalid status code", test.err, code, test.expected)
+		}
+	}
+}
+
+func TestClosedHandler(t *testing.T) {
+	s := testServer(HTTPOptions{}, &testHandler{})
+	defer s.close()
+	s.handler.Close()
+	code, _, err := testGet(s.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != http.StatusServiceUnavailable {
+		t.Error("invalid status code", code)
+	}
+}
+
+func TestLabelStats(t *testing.T) {
+	s := testServer(HTTPOptions{
+		Options:   Options{MaxStackSize: 1, Timeout: 30 * time.Millisecond},
+		MaxLabels: 2,
+	}, &testHandler{})
+
+	defer s.close()
+	done, err := s.handler.stack.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := make(chan int)
+	go func() {
+		c, _ := mustGet(t, s.url+"/foo")
+		dropped <- c
+	}()
+
+	for s.handler.stack.Status().QueuedJobs != 1 {
+	}
+
+	if c, _ := mustGet(t, s.url+"/bar"); c != http.StatusServiceUnavailable {
+		t.Error("failed to time out", c)
+	}
+
+	if c := <-dropped; c != http.StatusServiceUnavailable {
+		t.Error("failed to drop", c)
+	}
+
+	done()
+	mustGet(t, s.url+"/foo")
+	mustGet(t, s.url+"/baz")
+	expected := map[string][3]int{
+		"/foo": {1, 1, 0},
+		"/bar": {0, 0, 1},
+		"":     {1, 0, 0},
+	}
+
+	if stats := s.handler.LabelStats(); !reflect.DeepEqual(stats, expected) {
+		t.Error("invalid label stats", stats)
+	}
+}
+
 func TestBasicServe(t *testing.T) {
 	s := testServer(HTTPOptions{Options: Options{MaxConcurrency: 1}}, &testHandler{})
 	defer s.close()
@@ -209,6 +496,312 @@ func TestServeCancel(t *testing.T) {
 	})
 }
 
+func TestOnComplete(t *testing.T) {
+	var waited time.Duration
+	s := testServer(HTTPOptions{
+		OnComplete: func(w http.ResponseWriter, _ *http.Request, d time.Duration) {
+			waited = d
+			w.Header().Set("X-Server-Id", "test-server")
+		},
+	}, &testHandler{})
+	defer s.close()
+
+	rsp, err := http.Get(s.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Error("unexpected status code", rsp.StatusCode, "expected", http.StatusOK)
+	}
+
+	if h := rsp.Header.Get("X-Server-Id"); h != "test-server" {
+		t.Error("failed to set header", h)
+	}
+
+	if waited < 0 {
+		t.Error("invalid wait duration", waited)
+	}
+}
+
+func TestOnServed(t *testing.T) {
+	type served struct {
+		path string
+		wait time.Duration
+		shed bool
+	}
+
+	results := make(chan served, 2)
+	s := testServer(HTTPOptions{
+		Options: Options{MaxStackSize: 1, EvictOrder: EvictNewest},
+		OnServed: func(r *http.Request, queueWait time.Duration, shed bool) {
+			results <- served{path: r.URL.Path, wait: queueWait, shed: shed}
+		},
+	}, &testHandler{})
+
+	defer s.close()
+	done, err := s.handler.stack.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go http.Get(s.url + "/served")
+	for s.handler.stack.Status().QueuedJobs != 1 {
+	}
+
+	if c, _ := mustGet(t, s.url+"/shed"); c != http.StatusServiceUnavailable {
+		t.Error("failed to shed", c)
+	}
+
+	if r := <-results; r.path != "/shed" || !r.shed || r.wait > 120*time.Millisecond {
+		t.Error("invalid shed request", r)
+	}
+
+	time.Sleep(12 * time.Millisecond)
+	done()
+	if r := <-results; r.path != "/served" || r.shed || r.wait < 12*time.Millisecond || r.wait > 120*time.Millisecond {
+		t.Error("invalid served request", r)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	s := testServer(HTTPOptions{ServerTiming: true}, &testHandler{})
+	defer s.close()
+
+	rsp, err := http.Get(s.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rsp.Body.Close()
+	if h := rsp.Header.Get("Server-Timing"); !regexp.MustCompile(`^queue;dur=[0-9]+\.[0-9]{3}$`).MatchString(h) {
+		t.Error("invalid Server-Timing header", h)
+	}
+
+	if h := serverTiming(12345 * time.Microsecond); h != "queue;dur=12.345" {
+		t.Error("invalid format", h)
+	}
+}
+
+func TestScheduleOrder(t *testing.T) {
+	// measures the longest wait under saturation, in the number of the served
+	// requests, one new request arriving whenever one finishes:
+	maxWait := func(order ScheduleOrder) int {
+		scheduled := make(chan int)
+		release := make(chan struct{})
+		s := testServer(HTTPOptions{Options: Options{ScheduleOrder: order}}, http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+				scheduled <- id
+				<-release
+			},
+		))
+
+		defer s.close()
+
+		var wg sync.WaitGroup
+		arrived := make(map[int]int)
+		send := func(id, step int) {
+			arrived[id] = step
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if c, _ := mustGet(t, fmt.Sprintf("%s?id=%d", s.url, id)); c != http.StatusOK {
+					t.Error("unexpected status code", c)
+				}
+			}()
+		}
+
+		waits := map[int]int{0: 0}
+		send(0, 0)
+		<-scheduled
+		for id := 1; id < 3; id++ {
+			send(id, 0)
+			for s.handler.stack.Status().QueuedJobs != id {
+			}
+		}
+
+		const steps = 6
+		for step := 1; step <= steps; step++ {
+			send(step+2, step)
+			for s.handler.stack.Status().QueuedJobs != 3 {
+			}
+
+			release <- struct{}{}
+			id := <-scheduled
+			waits[id] = step - arrived[id]
+		}
+
+		var max int
+		for id, step := range arrived {
+			w, ok := waits[id]
+			if !ok {
+				w = steps - step
+			}
+
+			if w > max {
+				max = w
+			}
+		}
+
+		close(release)
+		go func() {
+			for range scheduled {
+			}
+		}()
+
+		wg.Wait()
+		close(scheduled)
+		return max
+	}
+
+	if fifo, lifo := maxWait(ScheduleFIFO), maxWait(ScheduleLIFO); fifo >= lifo {
+		t.Error("failed to bound the wait with FIFO", fifo, lifo)
+	}
+}
+
+func TestSetHandler(t *testing.T) {
+	s := testServer(HTTPOptions{Options: Options{MaxConcurrency: 3}}, &testHandler{})
+	defer s.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			c, _ := mustGetSlow(t, s.url, time.Millisecond)
+			if c != http.StatusOK && c != http.StatusNotFound {
+				t.Error("unexpected status code", c)
+			}
+
+			wg.Done()
+		}()
+
+		switch i {
+		case 4:
+			s.handler.SetHandler(nil)
+		case 8:
+			s.handler.SetHandler(&testHandler{})
+		}
+	}
+
+	wg.Wait()
+
+	s.handler.SetHandler(nil)
+	if c, _ := mustGet(t, s.url); c != http.StatusNotFound {
+		t.Error("unexpected status code", c, "expected", http.StatusNotFound)
+	}
+
+	s.handler.SetHandler(&testHandler{})
+	if c, _ := mustGet(t, s.url); c != http.StatusOK {
+		t.Error("unexpected status code", c, "expected", http.StatusOK)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	chain := func(h http.Handler, m ...func(http.Handler) http.Handler) http.Handler {
+		for i := len(m) - 1; i >= 0; i-- {
+			h = m[i](h)
+		}
+
+		return h
+	}
+
+	header := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Chain", "true")
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	throttle := Middleware(HTTPOptions{Options: Options{MaxConcurrency: 2}})
+	h := &testHandler{}
+	mux := http.NewServeMux()
+	mux.Handle("/foo", chain(h, header, throttle))
+	mux.Handle("/bar", chain(h, header, throttle))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			p := "/foo"
+			if i%2 == 1 {
+				p = "/bar"
+			}
+
+			if c, _ := mustGetSlow(t, s.URL+p, 9*time.Millisecond); c != http.StatusOK {
+				t.Error("unexpected status code", c)
+			}
+
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+	if h.counter.maxJobs != 2 {
+		t.Errorf("failed to share the stack. Observed: %d, expected %d", h.counter.maxJobs, 2)
+	}
+}
+
+func TestMiddlewareWithStack(t *testing.T) {
+	stack := New()
+	throttle := MiddlewareWithStack(HTTPOptions{}, stack)
+	s := httptest.NewServer(throttle(&testHandler{}))
+	defer s.Close()
+
+	if c, _ := mustGet(t, s.URL); c != http.StatusOK {
+		t.Error("unexpected status code", c)
+	}
+
+	stack.Close()
+	if c, _ := mustGet(t, s.URL); c != http.StatusServiceUnavailable {
+		t.Error("failed to close the stack of the middleware", c)
+	}
+}
+
+func TestSharedStack(t *testing.T) {
+	stack := With(Options{MaxConcurrency: 2})
+	defer stack.Close()
+
+	h := &testHandler{}
+	foo := NewHandlerWithStack(HTTPOptions{}, stack, h)
+	bar := NewHandlerWithStack(HTTPOptions{}, stack, h)
+	mux := http.NewServeMux()
+	mux.Handle("/foo", foo)
+	mux.Handle("/bar", bar)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			p := "/foo"
+			if i%2 == 1 {
+				p = "/bar"
+			}
+
+			if c, _ := mustGetSlow(t, s.URL+p, 9*time.Millisecond); c != http.StatusOK {
+				t.Error("unexpected status code", c)
+			}
+
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+	if h.counter.maxJobs != 2 {
+		t.Errorf("failed to limit the combined concurrency. Observed: %d, expected %d", h.counter.maxJobs, 2)
+	}
+
+	foo.Close()
+	if c, _ := mustGet(t, s.URL+"/bar"); c != http.StatusOK {
+		t.Error("closing a handler closed the shared stack", c)
+	}
+}
+
 func TestThrottlingOptions(t *testing.T) {
 	// status code for stack size
 	// status code for timeout
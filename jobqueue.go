@@ -1,20 +1,130 @@
 package jobqueue
 
 import (
-	"container/list"
+	"context"
 	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+type closeMode int
+
+const (
+	closeGraceful closeMode = iota
+	closeDrainRunning
+	closeForced
+)
+
+// maxFairIDs limits how many caller identities submitted with WaitFair are
+// remembered.
+const maxFairIDs = 1024
+
+type cancelRequest struct {
+	job     *job
+	removed chan bool
+}
+
 type job struct {
-	notify  chan error
-	timeout <-chan time.Time
-	entry   *list.Element
+	owner     atomic.Value
+	notify    chan error
+	timeout   <-chan time.Time
+	queued    bool
+	stacked   bool
+	submitted time.Time
+	started   time.Time
+	meta      interface{}
+	estimate  time.Duration
+	weight    int
+	size      int
+
+	limitBacklog bool
+	maxBacklog   int
+	noQueue      bool
+	fairID       string
+	sequenced    bool
+	seq          uint64
+	withStatus   bool
+	hasStatus    bool
+	status       Status
+	running      bool
+	finishing    bool
+	graced       bool
+	inScheduler  bool
+	dedupKey     string
+	leader       *job
+	followers    []*job
+	holders      int32
+	mirrored     chan struct{}
+	trace        []uintptr
+}
+
+// Breaker configures a circuit breaker for the stack. When the number of the
+// dropped or timed out jobs reaches the threshold within the window, the
+// breaker opens, and the stack rejects all the new jobs with ErrCircuitOpen.
+// After the cooldown, the breaker allows a single probe job. If the probe gets
+// scheduled, the breaker closes, otherwise it opens again.
+type Breaker struct {
+
+	// Threshold defines how many shed jobs trip the breaker. Defaults to 0,
+	// meaning that the breaker is disabled.
+	Threshold int
+
+	// Window defines the period in which the shed jobs are counted.
+	Window time.Duration
+
+	// Cooldown defines how long the breaker stays open.
+	Cooldown time.Duration
 }
 
+// BreakerState represents the state of the circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed means that the stack accepts the jobs normally.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen means that the stack rejects all the new jobs.
+	BreakerOpen
+
+	// BreakerHalfOpen means that the stack accepts a probe job.
+	BreakerHalfOpen
+)
+
+// ScheduleOrder defines the order in which the queued jobs are scheduled.
+type ScheduleOrder int
+
+const (
+	// ScheduleLIFO schedules the newest queued job first.
+	ScheduleLIFO ScheduleOrder = iota
+
+	// ScheduleFIFO schedules the oldest queued job first.
+	ScheduleFIFO
+)
+
+// EvictOrder defines which job is dropped when the stack is full.
+type EvictOrder int
+
+const (
+	// EvictOldest drops the oldest queued job, and queues the new one.
+	EvictOldest EvictOrder = iota
+
+	// EvictNewest drops the newest job, i.e. it rejects the incoming job
+	// without queueing it.
+	EvictNewest
+)
+
 // Options allows passing in parameters to the stack.
 type Options struct {
 
+	// Name identifies the stack. When set, the errors returned by the stack
+	// are of type *Error, containing the name. The name cannot be changed
+	// with Reconfigure.
+	Name string
+
 	// MaxConcurrency defines how many jobs are allowed to run concurrently.
 	// Defaults to 1.
 	MaxConcurrency int
@@ -23,13 +133,334 @@ type Options struct {
 	// Defaults to infinite.
 	MaxStackSize int
 
+	// Preallocate, when set together with MaxStackSize, makes the stack
+	// allocate the space for MaxStackSize queued jobs at construction, instead
+	// of growing it on demand. It trades memory for fewer allocations during
+	// the first burst of jobs. It cannot be changed with Reconfigure.
+	Preallocate bool
+
+	// MaxQueuedBytes defines the maximum total size of the metadata of the
+	// queued jobs, measured by SizeOf. When exceeded, the stack drops the
+	// queued jobs according to EvictOrder, until the total size fits,
+	// independent of the number of the queued jobs. A job that is larger than
+	// MaxQueuedBytes on its own is rejected with ErrStackFull without
+	// queueing it. Defaults to infinite.
+	MaxQueuedBytes int
+
+	// SizeOf, when set, returns the size in bytes of the metadata of a job,
+	// passed in with WaitMeta. It is called from the control loop of the
+	// stack, so it should return fast, and it must not call the methods of
+	// the stack.
+	SizeOf func(meta interface{}) int
+
 	// Timeout defines how long a job can be waiting in the stack.
 	// Defaults to infinite.
 	Timeout time.Duration
 
+	// RecencyCap limits how many times in a row the newest queued job can be
+	// scheduled. When the limit is reached, the oldest queued job is scheduled
+	// next, and the counting starts again. It allows blending the LIFO
+	// throughput with some FIFO fairness, ensuring that the oldest jobs
+	// eventually get processed under a steady stream of new jobs. Defaults
+	// to 0, meaning pure LIFO.
+	RecencyCap int
+
+	// ShortestJobFirst, when set, makes the stack schedule the queued job
+	// with the smallest estimated duration first, when a slot frees up. The
+	// estimate can be set with WaitEstimate. The jobs without an estimate are
+	// scheduled after the ones with an estimate, and the jobs with equal
+	// estimates are scheduled in the normal order.
+	//
+	// Long jobs can starve under a steady load of shorter ones. Setting a
+	// Timeout or RecencyCap limits how long they can be waiting.
+	ShortestJobFirst bool
+
+	// ScheduleOrder and EvictOrder define the order of scheduling and
+	// dropping of the queued jobs, independently:
+	//
+	// - ScheduleLIFO with EvictOldest, the default, favors the recent jobs, both
+	// when scheduling and when dropping, maximizing the chance that the
+	// callers still wait for the result.
+	//
+	// - ScheduleLIFO with EvictNewest schedules the recent jobs first, but
+	// keeps the older ones queued when the stack is full, until they time
+	// out.
+	//
+	// - ScheduleFIFO with EvictOldest is a classic queue that drops the jobs
+	// which waited the longest.
+	//
+	// - ScheduleFIFO with EvictNewest processes the jobs in the order of
+	// arrival, and under overload it drops the new arrivals, which haven't
+	// waited yet.
+	ScheduleOrder ScheduleOrder
+
+	// EvictOrder, see ScheduleOrder.
+	EvictOrder EvictOrder
+
+	// SpillOnFull, when set, makes the jobs dropped by the stack with
+	// ErrStackFull fall back to the spill stack, instead of returning the
+	// error. The job is submitted to the spill stack as a new job, so it is
+	// placed on the top of it, according to its own order, and it may be
+	// dropped by it again, in which case the caller receives the error
+	// returned by the spill stack. The returned done() function releases the
+	// slot in the stack that executes the job, and the caller cannot tell which
+	// stack that was, unless it checks their status. The spill stack needs to
+	// be closed separately. It cannot be changed with Reconfigure.
+	SpillOnFull *Stack
+
+	// Scheduler, when set, defines the order of scheduling and dropping the
+	// queued jobs, instead of the ScheduleOrder, EvictOrder, RecencyCap and
+	// ShortestJobFirst options, and the ordering of WaitFair. It is optional,
+	// the stack doesn't use a scheduler by default, not even LIFO, which is
+	// only provided as a base for custom schedulers. It cannot be changed with
+	// Reconfigure.
+	Scheduler Scheduler
+
+	// OnReconfigure, when set, is called every time after the options were
+	// changed with Reconfigure, receiving the previous and the new effective
+	// options. The callback of the new options is used. It is called from
+	// the control loop of the stack, so it should return fast, and it must
+	// not call the methods of the stack.
+	OnReconfigure func(old, new Options)
+
+	// FailFastOnTimeout, when set together with Timeout, makes the stack reject
+	// the incoming jobs immediately with ErrTimeout, instead of queueing them,
+	// when the estimated wait time already exceeds the timeout. The estimate
+	// is based on the number of the queued jobs, the concurrency level and the
+	// average execution time of the recently finished jobs.
+	FailFastOnTimeout bool
+
+	// Strict, when set at construction, makes Reconfigure reject invalid
+	// options with ErrInvalidOptions, instead of replacing the invalid values
+	// with the defaults, e.g. MaxConcurrency <= 0 with 1. It cannot be changed
+	// with Reconfigure.
+	Strict bool
+
+	// OnDrained, when set, is called every time when the stack becomes idle,
+	// i.e. the number of the active and the queued jobs drops to zero. It can
+	// be called multiple times, e.g. once after each processed batch of jobs.
+	// It is called from the control loop of the stack, so it should return
+	// fast, and it must not call the methods of the stack.
+	OnDrained func()
+
+	// OnShutdownJob, when set, is called with the metadata of every queued
+	// job that gets rejected during the teardown, e.g. by CloseForced or
+	// when the close timeout has passed, allowing to re-route the work, e.g.
+	// to a fallback executor. The original caller still receives
+	// ErrClosedWhileQueued. The jobs queued during a graceful Close are still
+	// processed, so it is not called for them, unless the close timeout
+	// passes. It is called from the control loop of the stack, so it should
+	// return fast, and it must not call the methods of the stack.
+	OnShutdownJob func(meta interface{})
+
+	// Admit, when set, is called when a job would be queued, because there
+	// is no free slot to schedule it immediately, receiving the metadata of
+	// the job and the current status of the stack. When it returns false,
+	// the job is rejected with ErrAdmissionDenied. It is called from the
+	// control loop of the stack, so it should return fast, and it must not
+	// call the methods of the stack.
+	Admit func(meta interface{}, s Status) bool
+
+	// SlowThreshold, when set, makes the stack count the jobs whose execution,
+	// from being scheduled until done() is called, takes longer than the
+	// threshold. The slow jobs are not interrupted.
+	SlowThreshold time.Duration
+
+	// OnSlowJob, when set together with SlowThreshold, is called with the
+	// execution time of every slow job. It is called from the control loop of
+	// the stack, so it should return fast, and it must not call the methods
+	// of the stack.
+	OnSlowJob func(d time.Duration)
+
+	// SustainedWindow defines how long a period without dropped or timed out
+	// jobs needs to last, to be considered by SustainedConcurrency. Defaults
+	// to one minute.
+	SustainedWindow time.Duration
+
+	// SnapshotStatus, when set, makes Status read a snapshot published by the
+	// control loop after processing each event, instead of sending a request
+	// to the control loop. This way frequent Status calls, e.g. by monitoring,
+	// don't compete with the scheduling of the jobs. The snapshot lags behind
+	// the operations that are still being processed by the control loop, e.g.
+	// it may not yet reflect a job that was just scheduled, but it's always
+	// internally consistent. It cannot be changed with Reconfigure.
+	SnapshotStatus bool
+
+	// IntakeBuffer sets how many submitted jobs can be buffered before the
+	// control loop accepts them, so that the callers submitting a burst of
+	// jobs don't need to wait for the control loop one by one. The buffered
+	// jobs are not yet visible in the Status, e.g. in QueuedJobs, and the
+	// limits of the stack are applied to them only once the control loop
+	// accepts them, so a larger buffer slightly delays the effect of the
+	// submissions. Defaults to 0, meaning no buffering. It cannot be changed
+	// with Reconfigure.
+	IntakeBuffer int
+
+	// MaxHeartbeatRate, when set, limits how many times per second the
+	// heartbeats started with Heartbeat read the status from the control loop,
+	// all together. The interval of a heartbeat is raised to the minimum
+	// interval allowed by the rate, and the heartbeats ticking within the same
+	// interval receive the same, coalesced status, so the intermediate samples
+	// are dropped. Defaults to unlimited. It cannot be changed with
+	// Reconfigure.
+	MaxHeartbeatRate int
+
+	// ReleaseTimeout, when set, limits how long done() can be blocked, waiting
+	// for the control loop to accept the release of the slot, e.g. when the
+	// loop is wedged by a blocking callback. When the timeout passes, done()
+	// gives up, and the release is counted in the AbandonedReleases field of
+	// the status. The slot of such a job is never released, so even if the
+	// loop recovers later, the stack counts the job as active, and its
+	// capacity is reduced by one. It cannot be changed with Reconfigure.
+	ReleaseTimeout time.Duration
+
+	// SequenceTimeout defines how long the jobs submitted with WaitSeq out of
+	// order are held back, waiting for the jobs with the missing sequence
+	// numbers. Defaults to 100 milliseconds.
+	SequenceTimeout time.Duration
+
+	// Breaker configures the circuit breaker of the stack. Disabled by
+	// default.
+	Breaker Breaker
+
+	// PanicHandler, when set, is called with the recovered value when a job
+	// started with Go panics. The slot of the job is released, and the stack
+	// keeps processing the other jobs. When not set, the panic is not
+	// recovered. It cannot be changed with Reconfigure.
+	PanicHandler func(recovered interface{})
+
+	// OnSchedule, when set, is called with the metadata of a job, when the
+	// job is granted a slot.
+	OnSchedule func(meta interface{})
+
+	// OnDone, when set, is called with the metadata of a job, when done() is
+	// called for the job, receiving how long the job was holding the slot,
+	// from being scheduled until released.
+	//
+	// OnSchedule and OnDone are called from the control loop of the stack, so
+	// they should return fast, and they must not call the methods of the
+	// stack.
+	OnDone func(meta interface{}, heldFor time.Duration)
+
+	// Reporter, when set, receives notifications about the jobs processed by
+	// the stack.
+	Reporter Reporter
+
+	// Labels contains static labels identifying the stack in the metrics, e.g.
+	// the service or the region. When the Reporter implements
+	// LabeledReporter, it receives the labels before any notification. The
+	// labels cannot be changed with Reconfigure.
+	Labels map[string]string
+
+	// TimeoutGrace, when set, allows extending the timeout of the oldest
+	// queued job once, by the grace period, when it would time out while a
+	// running job, started with WaitFinishing, has signaled that it is about to
+	// release its slot. The extended job gets the next free slot. It is a best
+	// effort measure against dropping a job right before a slot frees up, and
+	// it doesn't guarantee that the job gets scheduled within the grace period.
+	TimeoutGrace time.Duration
+
 	// CloseTimeout sets a maximum duration for how long the queue can wait
 	// for the active and queued jobs to finish. Defaults to infinite.
 	CloseTimeout time.Duration
+
+	// MaxTotalJobs, when set, makes the stack close itself once it has
+	// scheduled the defined number of jobs, e.g. for running a batch of jobs.
+	// The stack doesn't schedule more jobs than MaxTotalJobs, even when it has
+	// free slots, and once the limit is reached, the queued jobs and the ones
+	// submitted later receive an error matching ErrClosed, while the running
+	// ones can finish. With MaxConcurrency higher than 1, the jobs that are
+	// granted the last slots are not necessarily the ones that were submitted
+	// the earliest. The jobs executed in the slots reserved with Reserve are
+	// not counted.
+	MaxTotalJobs int
+
+	// MaxLifetime, when set, makes the stack close itself after the lifetime
+	// has passed since its creation, regardless of the activity, e.g. as a
+	// safety net against leaking stacks created for a batch of jobs. The stack
+	// is closed the same way as with Close: the queued and the active jobs
+	// still drain, subject to the CloseTimeout. It cannot be changed with
+	// Reconfigure.
+	MaxLifetime time.Duration
+
+	// TrackQueueDepth, when set, makes the stack record the distribution of
+	// the number of the queued jobs, which can be retrieved with
+	// QueueDepthHistogram. It is disabled by default, to avoid the overhead.
+	TrackQueueDepth bool
+
+	// InstrumentLoop, when set, makes the stack measure the time spent by its
+	// control loop handling the different kinds of events, and the time spent
+	// waiting for them. The measurements can be retrieved with LoopStats. It
+	// is disabled by default, to avoid the overhead.
+	InstrumentLoop bool
+
+	// Debug, when set, makes the stack capture the stack trace of the callers
+	// acquiring a slot, which can be retrieved with ActiveHolders, e.g. to find
+	// the callers that leak slots. It is disabled by default, because capturing
+	// the stack traces is expensive. It cannot be changed with Reconfigure.
+	Debug bool
+}
+
+// Stats contains the cumulative counters of the jobs processed by a stack.
+type Stats struct {
+
+	// Since contains the start of the period covered by the counters.
+	Since time.Time
+
+	// Scheduled contains the number of the scheduled jobs.
+	Scheduled int
+
+	// Completed contains the number of the finished jobs.
+	Completed int
+
+	// Dropped contains the number of the jobs dropped with ErrStackFull.
+	Dropped int
+
+	// DroppedByOverload contains the number of the dropped jobs that were
+	// not evicted by Reconfigure.
+	DroppedByOverload int
+
+	// DroppedByReconfigure contains the number of the dropped jobs that were
+	// evicted by Reconfigure, receiving ErrEvictedByReconfigure.
+	DroppedByReconfigure int
+
+	// TimedOut contains the number of the jobs rejected with ErrTimeout.
+	TimedOut int
+}
+
+// LoopStats contains the aggregate time spent by the control loop of a stack,
+// measured when the InstrumentLoop option is set.
+type LoopStats struct {
+
+	// Blocked contains the time spent waiting for events.
+	Blocked time.Duration
+
+	// Submit contains the time spent accepting the new jobs.
+	Submit time.Duration
+
+	// Adopt contains the time spent accepting the migrated jobs.
+	Adopt time.Duration
+
+	// Done contains the time spent processing the finished jobs.
+	Done time.Duration
+
+	// Cancel contains the time spent processing the canceled jobs.
+	Cancel time.Duration
+
+	// Timeout contains the time spent rejecting the timed out jobs.
+	Timeout time.Duration
+
+	// Status contains the time spent on the status requests.
+	Status time.Duration
+
+	// Reconfigure contains the time spent applying new options.
+	Reconfigure time.Duration
+
+	// Call contains the time spent on the other calls, like Pause or Resume.
+	Call time.Duration
+
+	// Quit contains the time spent on processing the close requests.
+	Quit time.Duration
 }
 
 // Status contains snapshot information about the state of the queue.
@@ -46,44 +477,326 @@ type Status struct {
 
 	// Closed indicates that the queues has been closed.
 	Closed bool
+
+	// Paused indicates that the scheduling of the jobs was paused.
+	Paused bool
+
+	// Breaker contains the state of the circuit breaker.
+	Breaker BreakerState
+
+	// Reconfigurations contains how many times the queue was reconfigured.
+	Reconfigurations int
+
+	// LastReconfigure contains the time of the last reconfiguration. It is
+	// zero if the queue was never reconfigured.
+	LastReconfigure time.Time
+
+	// PendingReleases contains the number of finished jobs whose done()
+	// call is blocked, waiting for the queue to accept the release of the
+	// slot. A persistently high value signals a problem.
+	PendingReleases int
+
+	// SlowJobs contains the number of the finished jobs that took longer
+	// than the SlowThreshold option.
+	SlowJobs int
+
+	// QueuedBytes contains the total size of the metadata of the queued
+	// jobs, measured by the SizeOf option.
+	QueuedBytes int
+
+	// AbandonedReleases contains the number of the done() calls that gave up
+	// waiting for the control loop, after the ReleaseTimeout has passed.
+	AbandonedReleases int
+
+	// BlockedWaiters contains the number of the callers blocked on submitting
+	// a job to the queue, not yet accepted by the control loop. Unlike
+	// QueuedJobs, a high value indicates contention on the control loop
+	// itself.
+	BlockedWaiters int
+
+	// DroppedByOverload contains the number of the jobs dropped with
+	// ErrStackFull since the queue was created, except for the ones evicted
+	// by Reconfigure.
+	DroppedByOverload int
+
+	// DroppedByReconfigure contains the number of the jobs evicted by
+	// Reconfigure since the queue was created.
+	DroppedByReconfigure int
+}
+
+// Reporter can be used to receive notifications about the jobs processed by a
+// stack, e.g. to collect metrics. The meta argument contains the metadata
+// passed in to WaitMeta, or nil. The methods are called from the control loop
+// of the stack, so they should return fast, and they must not call the methods
+// of the stack.
+type Reporter interface {
+
+	// JobScheduled is called when a job gets a slot to be executed.
+	JobScheduled(meta interface{})
+
+	// JobDone is called when an executed job releases its slot.
+	JobDone(meta interface{})
+
+	// JobDropped is called when a job is rejected, with the reason of the
+	// rejection, e.g. ErrStackFull or an error matching ErrTimeout.
+	JobDropped(meta interface{}, reason error)
+}
+
+// LabeledReporter is a Reporter that receives the static labels of the stack,
+// set with the Labels option, so that it can tag the metrics that it emits.
+type LabeledReporter interface {
+	Reporter
+
+	// SetLabels is called once with the labels of the stack, when the
+	// reporter is set with the options, before any other notification.
+	SetLabels(labels map[string]string)
+}
+
+// Queue is the common interface of the job queues, implemented by *Stack. It
+// allows the code using a stack to depend on the interface, and replace the
+// stack with a fake implementation, e.g. in tests.
+type Queue interface {
+	Wait() (done func(), err error)
+	Do(job func()) error
+	Status() Status
+	Close()
 }
 
+var _ Queue = (*Stack)(nil)
+
 // Stack controls how long running or otherwise expensive jobs are executed. It allows
-// the jobs to proceed with limited concurrency. The incoming jobs are executed in LIFO
-// style (Last-in-first-out).
+// the jobs to proceed with limited concurrency. By default, the incoming jobs are
+// executed in LIFO style (Last-in-first-out), see the ScheduleOrder option.
 //
 // Jobs also can be dropped or timed out, when the MaxStackSize and/or Timeout options
-// are set. When MaxStackSize is reached, the oldest job is dropped.
+// are set. When MaxStackSize is reached, a job is dropped according to the EvictOrder
+// option, by default the oldest one.
 //
 // Using a stack for job processing can be a good way to protect an application from
 // bursts of chatty clients or temporarily slow job execution.
 type Stack struct {
-	options     Options
-	stack       *stack
-	req         chan *job
-	done        chan struct{}
-	quit        chan bool
-	closing     bool
-	status      chan chan Status
-	reconfigure chan Options
-	hasQuit     chan struct{}
-	busy        int
-}
+	pendingReleases   int64
+	blockedWaiters    int64
+	abandonedReleases int64
+	lastActivity      int64
+	releaseTimeout    time.Duration
+	snapshotStatus    bool
+	statusSnapshot    atomic.Value
+	debug             bool
+
+	heartbeatRate   int
+	heartbeatMx     sync.Mutex
+	heartbeatRead   time.Time
+	heartbeatStatus Status
+
+	name         string
+	strict       bool
+	panicHandler func(interface{})
+	scheduler    Scheduler
+	spill        *Stack
+	labels       map[string]string
+	options      Options
+	stack        *stack
+	req          chan *job
+	adopt        chan []*job
+	cancel       chan cancelRequest
+	done         chan *job
+	calls        chan func()
+	quit         chan closeMode
+	closing      bool
+	status       chan chan Status
+	reconfigure  chan Options
+	hasQuit      chan struct{}
+	busy         int
+	handingOver  int
+	idle         bool
+	paused       bool
+	recent       int
+	avgRun       time.Duration
+	fairTick     uint64
+	fairServed   map[string]uint64
+
+	reconfigurations int
+	lastReconfigure  time.Time
+
+	closeTimeout  <-chan time.Time
+	closeDeadline time.Time
+	lifetime      <-chan time.Time
+
+	boost        int
+	boostUntil   time.Time
+	boostTimeout <-chan time.Time
+
+	finishing int
+	graced    *job
 
-var token struct{}
+	loopStats   LoopStats
+	loopStarted time.Time
+	loopWoke    time.Time
+	loopSpent   *time.Duration
+
+	breaker      BreakerState
+	shedStart    time.Time
+	shedCount    int
+	breakerUntil time.Time
+	probe        *job
+	lastShed     time.Time
+
+	total    Stats
+	delta    Stats
+	slowJobs int
+
+	now           func() time.Time
+	shedFreeFrom  time.Time
+	shedFreePeak  int
+	sustainedPeak int
+
+	busyAt       time.Time
+	busyTime     float64
+	capacityTime float64
+
+	created        time.Time
+	firstScheduled time.Time
+
+	histograms map[histogramKey]*outcomeTracker
+	standby    *Stack
+	shadow     *Stack
+	held       []*job
+	depthWait  map[chan struct{}]int
+	dedup      map[string]*job
+
+	nextSeq    uint64
+	seqPending map[uint64]*job
+	seqTimeout <-chan time.Time
+}
 
 var (
 	// ErrStackFull is returned by the stack when the max stack size is reached.
 	ErrStackFull = errors.New("stack is full")
 
 	// ErrTimeout is returned by the stack when a pending job reached the timeout.
+	// The jobs timing out in the stack receive a *TimeoutError, matching
+	// ErrTimeout with errors.Is.
 	ErrTimeout = errors.New("timeout")
 
 	// ErrClosed is returned by the queue when called after the queue was closed, or when the
 	// queue was closed while a job was waiting to be scheduled.
 	ErrClosed = errors.New("queue closed")
+
+	// ErrClosedWhileQueued is returned by the queue when the queue was closed
+	// while a job was waiting to be scheduled. It matches ErrClosed with
+	// errors.Is, while it allows the callers to tell, whether the job was
+	// accepted before the queue was closed.
+	ErrClosedWhileQueued = fmt.Errorf("%w while the job was queued", ErrClosed)
+
+	// ErrEvictedByReconfigure is returned by the stack when a queued job was
+	// dropped, because Reconfigure decreased MaxStackSize or MaxQueuedBytes.
+	// It matches ErrStackFull with errors.Is.
+	ErrEvictedByReconfigure = fmt.Errorf("%w, evicted by reconfigure", ErrStackFull)
+
+	// ErrNilJob is returned by Do when it is called with a nil job.
+	ErrNilJob = errors.New("nil job")
+
+	// ErrDeadlineExceeded is returned by DoDeadline and DoDeadlineContext,
+	// when the job was scheduled, but it didn't finish within the deadline.
+	ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+	// ErrExecutionTimeout is returned by DoPhased, when the job was scheduled,
+	// but it didn't finish within its execution budget.
+	ErrExecutionTimeout = errors.New("execution timeout")
+
+	// ErrAdmissionDenied is returned by the stack when the Admit option
+	// rejected a job.
+	ErrAdmissionDenied = errors.New("admission denied")
+
+	// ErrCircuitOpen is returned by the stack when the circuit breaker is
+	// open.
+	ErrCircuitOpen = errors.New("circuit open")
+
+	// ErrBacklogTooDeep is returned by WaitUnlessBacklog when the number of
+	// the queued jobs reached the requested maximum.
+	ErrBacklogTooDeep = errors.New("backlog too deep")
+
+	// ErrInvalidOptions is returned by Reconfigure in strict mode, when the
+	// options contain invalid values.
+	ErrInvalidOptions = errors.New("invalid options")
+
+	errPauseWithZero = fmt.Errorf("%w: MaxConcurrency must be positive, use Pause to stop scheduling", ErrInvalidOptions)
+
+	errReserveNonPositive = fmt.Errorf("%w: the number of the reserved slots must be positive", ErrInvalidOptions)
+
+	errFailoverSelf = fmt.Errorf("%w: a stack cannot be its own standby", ErrInvalidOptions)
 )
 
+// Error is returned by the stacks that have a name. It wraps one of the
+// errors defined by the package, so errors.Is(err, ErrStackFull) can be used
+// to check the reason.
+type Error struct {
+
+	// Name contains the name of the stack that returned the error.
+	Name string
+
+	// Err contains the reason of the error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+// Unwrap returns the wrapped reason of the error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// RedirectError is returned by a closed stack, when a standby stack was
+// registered with Failover. The new jobs can be submitted to the standby. It
+// matches ErrClosed with errors.Is.
+type RedirectError struct {
+
+	// Standby contains the stack that took over the jobs.
+	Standby *Stack
+}
+
+func (e *RedirectError) Error() string {
+	return ErrClosed.Error() + ", redirected to standby"
+}
+
+// Unwrap returns ErrClosed.
+func (e *RedirectError) Unwrap() error {
+	return ErrClosed
+}
+
+// TimeoutError is returned by the stack when a queued job reached the timeout.
+// It matches ErrTimeout with errors.Is.
+type TimeoutError struct {
+
+	// Waited contains how long the job was waiting in the stack.
+	Waited time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return ErrTimeout.Error() + " after " + e.Waited.String()
+}
+
+// Unwrap returns ErrTimeout.
+func (e *TimeoutError) Unwrap() error {
+	return ErrTimeout
+}
+
+// TimeoutWaited tells whether an error returned by the stack matches
+// ErrTimeout, and if yes, how long the job was waiting before it timed out. It
+// returns zero for the jobs that were rejected without waiting, e.g. due to
+// the FailFastOnTimeout option.
+func TimeoutWaited(err error) (time.Duration, bool) {
+	var te *TimeoutError
+	if errors.As(err, &te) {
+		return te.Waited, true
+	}
+
+	return 0, errors.Is(err, ErrTimeout)
+}
+
 // New creates a Stack instance with a concurrency level of 1, and with infinite stack
 // size and timeout. See With(Options), too. The Stack needs to be closed once it's not
 // used anymore.
@@ -94,216 +807,2631 @@ func New() *Stack {
 // With creates a Stack instance configured by the Options parameter. The Stack needs to
 // be closed once it's not used anymore.
 func With(o Options) *Stack {
+	return withClock(o, time.Now)
+}
+
+// NewCPUBound creates a Stack instance for CPU-bound jobs, with MaxConcurrency
+// set to GOMAXPROCS. Running more CPU-bound jobs concurrently than the number
+// of the usable CPUs would only increase their latency, without increasing the
+// throughput.
+func NewCPUBound() *Stack {
+	return With(Options{MaxConcurrency: runtime.GOMAXPROCS(0)})
+}
+
+// NewIOBound creates a Stack instance for jobs that spend most of their time
+// waiting for I/O, e.g. for network calls, with MaxConcurrency set to
+// GOMAXPROCS multiplied by multiplier. The right multiplier depends on the
+// ratio of the waiting and the computation in the jobs. When multiplier <= 0,
+// it is treated as 1.
+func NewIOBound(multiplier int) *Stack {
+	if multiplier <= 0 {
+		multiplier = 1
+	}
+
+	return With(Options{MaxConcurrency: runtime.GOMAXPROCS(0) * multiplier})
+}
+
+func withClock(o Options, now func() time.Time) *Stack {
 	if o.MaxConcurrency <= 0 {
 		o.MaxConcurrency = 1
 	}
 
 	s := &Stack{
-		options:     o,
-		stack:       newStack(o.MaxStackSize),
-		req:         make(chan *job),
-		done:        make(chan struct{}),
-		quit:        make(chan bool),
-		hasQuit:     make(chan struct{}),
-		status:      make(chan chan Status),
-		reconfigure: make(chan Options),
+		now:            now,
+		shedFreeFrom:   now(),
+		busyAt:         now(),
+		created:        now(),
+		total:          Stats{Since: now()},
+		delta:          Stats{Since: now()},
+		name:           o.Name,
+		strict:         o.Strict,
+		panicHandler:   o.PanicHandler,
+		scheduler:      o.Scheduler,
+		spill:          o.SpillOnFull,
+		labels:         copyLabels(o.Labels),
+		snapshotStatus: o.SnapshotStatus,
+		releaseTimeout: o.ReleaseTimeout,
+		debug:          o.Debug,
+		heartbeatRate:  o.MaxHeartbeatRate,
+		options:        o,
+		stack:          newStack(o.MaxStackSize),
+		req:            make(chan *job, intakeBuffer(o.IntakeBuffer)),
+		adopt:          make(chan []*job),
+		cancel:         make(chan cancelRequest),
+		done:           make(chan *job),
+		calls:          make(chan func()),
+		quit:           make(chan closeMode),
+		hasQuit:        make(chan struct{}),
+		status:         make(chan chan Status),
+		reconfigure:    make(chan Options),
+		idle:           true,
+	}
+
+	s.lastActivity = now().UnixNano()
+
+	s.stack.trackDepths = o.TrackQueueDepth
+	s.setReporterLabels(o.Reporter)
+	if o.MaxLifetime > 0 {
+		s.lifetime = time.After(o.MaxLifetime)
+	}
+
+	if o.Preallocate && o.MaxStackSize > 0 {
+		s.stack.preallocate(o.MaxStackSize)
+	}
+
+	if s.snapshotStatus {
+		s.statusSnapshot.Store(s.snapshot())
 	}
 
 	go s.run()
 	return s
 }
 
+func intakeBuffer(n int) int {
+	if n < 0 {
+		return 0
+	}
+
+	return n
+}
+
+func copyLabels(l map[string]string) map[string]string {
+	if l == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(l))
+	for k, v := range l {
+		c[k] = v
+	}
+
+	return c
+}
+
+func (s *Stack) setReporterLabels(r Reporter) {
+	if lr, ok := r.(LabeledReporter); ok {
+		lr.SetLabels(copyLabels(s.labels))
+	}
+}
+
 func (s *Stack) rejectQueued() {
 	for !s.stack.empty() {
 		j := s.stack.shift()
-		j.notify <- ErrClosed
+		if s.options.OnShutdownJob != nil {
+			s.options.OnShutdownJob(j.meta)
+		}
+
+		s.reject(j, ErrClosedWhileQueued)
 	}
 }
 
-func (s *Stack) run() {
-	var closeTimeout <-chan time.Time
-	for {
-		var timeout <-chan time.Time
-		oldest := s.stack.bottom()
-		if oldest != nil {
-			timeout = oldest.timeout
+// next removes the job from the stack that needs to be scheduled next.
+func (s *Stack) next() *job {
+	if j := s.graced; j != nil {
+		s.graced = nil
+		if j.stacked && j.getOwner() == s {
+			s.stack.remove(j)
+			return j
 		}
+	}
 
-		select {
-		case j := <-s.req:
-			if s.options.Timeout > 0 {
-				j.timeout = time.After(s.options.Timeout)
-			}
+	if s.scheduler != nil {
+		return s.fromScheduler(s.scheduler.Pop, s.stack.pop)
+	}
 
-			if s.closing {
-				j.notify <- ErrClosed
-			} else if s.busy < s.options.MaxConcurrency {
-				s.busy++
-				j.notify <- nil
-			} else {
-				if s.stack.full() {
-					oldest := s.stack.shift()
-					oldest.notify <- ErrStackFull
-				}
+	if s.options.RecencyCap > 0 && s.recent >= s.options.RecencyCap {
+		s.recent = 0
+		return s.stack.shift()
+	}
 
-				s.stack.push(j)
-			}
-		case <-s.done:
-			s.busy--
-			if !s.stack.empty() && s.busy < s.options.MaxConcurrency {
-				s.busy++
-				j := s.stack.pop()
-				j.notify <- nil
-			}
+	s.recent++
+	if s.options.ShortestJobFirst {
+		return s.shortest()
+	}
 
-			if s.closing && s.busy == 0 && s.stack.empty() {
-				close(s.hasQuit)
-				return
-			}
-		case <-timeout:
-			oldest.notify <- ErrTimeout
-			s.stack.shift()
-		case status := <-s.status:
-			status <- Status{ActiveJobs: s.busy, QueuedJobs: s.stack.list.Len(), Closing: s.closing}
-		case o := <-s.reconfigure:
-			if o.MaxConcurrency <= 0 {
-				o.MaxConcurrency = 1
-			}
+	if s.fairServed != nil {
+		return s.fair()
+	}
 
-			s.options = o
-			s.stack.cap = o.MaxStackSize
+	if s.options.ScheduleOrder == ScheduleFIFO {
+		return s.stack.shift()
+	}
 
-			for s.busy < s.options.MaxConcurrency && !s.stack.empty() {
-				s.busy++
-				j := s.stack.pop()
-				j.notify <- nil
-			}
+	return s.stack.pop()
+}
 
-			for s.stack.list.Len() > s.stack.cap {
-				j := s.stack.shift()
-				j.notify <- ErrStackFull
-			}
-		case forced := <-s.quit:
-			if forced {
-				s.rejectQueued()
-				close(s.hasQuit)
-				return
-			}
+// evict removes the job to be dropped from a stack over its capacity.
+func (s *Stack) evict() *job {
+	if s.scheduler != nil {
+		return s.fromScheduler(s.scheduler.Evict, s.stack.shift)
+	}
 
-			s.closing = true
-			if s.busy == 0 && s.stack.empty() {
-				close(s.hasQuit)
-				return
-			}
+	if s.options.EvictOrder == EvictNewest {
+		return s.stack.pop()
+	}
 
-			if s.options.CloseTimeout > 0 {
-				closeTimeout = time.After(s.options.CloseTimeout)
-			}
-		case <-closeTimeout:
-			s.rejectQueued()
-			close(s.hasQuit)
-			return
+	return s.stack.shift()
+}
+
+// fromScheduler removes the job returned by the Scheduler option from the
+// stack, skipping the jobs that already left it. If the scheduler has no more
+// jobs, it falls back to the default order.
+func (s *Stack) fromScheduler(take func() QueuedJob, fallback func() *job) *job {
+	for s.scheduler.Len() > 0 {
+		j := take().job
+		if j == nil {
+			continue
+		}
+
+		j.inScheduler = false
+		if j.stacked && j.getOwner() == s {
+			s.stack.remove(j)
+			return j
 		}
 	}
+
+	return fallback()
 }
 
-func (s *Stack) newJob() *job {
-	return &job{notify: make(chan error)}
+// queue pushes a job to the stack and, when set, to the Scheduler option.
+func (s *Stack) queue(j *job) {
+	s.stack.push(j)
+	s.pushScheduler(j)
 }
 
-// Wait returns when a job can be processed, or it should be cancelled. The notion of
-// the actual 'job' to be processed is completely up to the calling code.
-//
-// When a job can be processed, Wait returns a non-nil done() function, which must be
-// called after the job was done, in order to free-up a slot for the next job.
-//
-// When the job needs to be droppped, Wait returns ErrStackFull. When the job timed out,
-// Wait returns ErrTimeout. In these cases, done() must not be called, and it may be
-// nil.
-//
-// Wait doesn't return other errors than ErrStackFull or ErrTimeout.
-func (s *Stack) Wait() (done func(), err error) {
-	j := s.newJob()
-	select {
-	case s.req <- j:
-		err = <-j.notify
-		if err != nil {
-			done = func() {}
-		} else {
-			done = func() {
-				select {
-				case s.done <- token:
-				case <-s.hasQuit:
-				}
-			}
-		}
-	case <-s.hasQuit:
-		err = ErrClosed
+func (s *Stack) pushScheduler(j *job) {
+	if s.scheduler == nil {
+		return
 	}
 
-	return
+	j.inScheduler = true
+	s.scheduler.Push(QueuedJob{job: j})
+}
+
+// unschedule removes a job from the Scheduler option, when it left the stack
+// without the scheduler returning it, e.g. because it timed out.
+func (s *Stack) unschedule(j *job) {
+	if !j.inScheduler {
+		return
+	}
+
+	j.inScheduler = false
+	s.scheduler.Remove(QueuedJob{job: j})
+}
+
+// fair removes the queued job whose caller identity was scheduled the least
+// recently, so that the identities take turns. The identities that were not
+// scheduled yet go first. Among the jobs of the same identity, the order of
+// the stack applies.
+func (s *Stack) fair() *job {
+	var (
+		next       *job
+		nextServed uint64
+	)
+
+	fifo := s.options.ScheduleOrder == ScheduleFIFO
+	s.stack.each(func(j *job) bool {
+		served := s.fairServed[j.fairID]
+		if next == nil || served < nextServed || fifo && served == nextServed {
+			next, nextServed = j, served
+		}
+
+		return true
+	})
+
+	s.stack.remove(next)
+	return next
+}
+
+// serveFair records when a caller identity was scheduled, once jobs were
+// submitted with WaitFair. To bound the memory, the identities without queued
+// jobs are forgotten when there are too many of them.
+func (s *Stack) serveFair(id string) {
+	if id == "" && s.fairServed == nil {
+		return
+	}
+
+	if len(s.fairServed) >= maxFairIDs {
+		served := make(map[string]uint64)
+		s.stack.each(func(j *job) bool {
+			if t, ok := s.fairServed[j.fairID]; ok {
+				served[j.fairID] = t
+			}
+
+			return true
+		})
+
+		s.fairServed = served
+	}
+
+	if s.fairServed == nil {
+		s.fairServed = make(map[string]uint64)
+	}
+
+	s.fairTick++
+	s.fairServed[id] = s.fairTick
+}
+
+// shortest removes the queued job with the smallest estimated duration.
+func (s *Stack) shortest() *job {
+	var shortest *job
+	s.stack.each(func(j *job) bool {
+		if shortest == nil || j.estimate > 0 && (shortest.estimate == 0 || j.estimate < shortest.estimate) {
+			shortest = j
+		}
+
+		return true
+	})
+
+	s.stack.remove(shortest)
+	return shortest
+}
+
+// recordShed counts a dropped or timed out job for the circuit breaker.
+func (s *Stack) recordShed() {
+	b := s.options.Breaker
+	if b.Threshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(s.shedStart) > b.Window {
+		s.shedStart = now
+		s.shedCount = 0
+	}
+
+	s.shedCount++
+	if s.shedCount >= b.Threshold {
+		s.openBreaker(now)
+	}
+}
+
+func (s *Stack) openBreaker(now time.Time) {
+	s.breaker = BreakerOpen
+	s.breakerUntil = now.Add(s.options.Breaker.Cooldown)
+	s.shedCount = 0
+	s.probe = nil
+}
+
+// breakerOpen tells whether an incoming job needs to be rejected by the
+// circuit breaker.
+func (s *Stack) breakerOpen(j *job) bool {
+	switch s.breaker {
+	case BreakerOpen:
+		if time.Now().Before(s.breakerUntil) {
+			return true
+		}
+
+		s.breaker = BreakerHalfOpen
+		s.probe = j
+		return false
+	case BreakerHalfOpen:
+		if s.probe != nil {
+			return true
+		}
+
+		s.probe = j
+		return false
+	default:
+		return false
+	}
+}
+
+// leaveProbe allows a new probe, when the current probe left the stack without
+// being scheduled or rejected, e.g. because it was canceled or moved.
+func (s *Stack) leaveProbe(j *job) {
+	if j == s.probe {
+		s.probe = nil
+	}
+}
+
+func (s *Stack) sustainedWindow() time.Duration {
+	if s.options.SustainedWindow <= 0 {
+		return time.Minute
+	}
+
+	return s.options.SustainedWindow
+}
+
+// endShedFree closes the current shed-free interval, and stores its peak
+// concurrency, if it was long enough.
+func (s *Stack) endShedFree() {
+	now := s.now()
+	if now.Sub(s.shedFreeFrom) >= s.sustainedWindow() {
+		s.sustainedPeak = s.shedFreePeak
+	}
+
+	s.shedFreeFrom = now
+	s.shedFreePeak = s.busy
+}
+
+func (s *Stack) sustained() int {
+	if s.now().Sub(s.shedFreeFrom) >= s.sustainedWindow() {
+		return s.shedFreePeak
+	}
+
+	return s.sustainedPeak
+}
+
+func (s *Stack) schedule(j *job) {
+	s.unschedule(j)
+	if j == s.probe {
+		s.breaker = BreakerClosed
+		s.probe = nil
+	}
+
+	s.accountBusy()
+	if s.firstScheduled.IsZero() {
+		s.firstScheduled = s.now()
+	}
+
+	s.busy++
+	s.total.Scheduled++
+	s.delta.Scheduled++
+	s.recordOutcome(outcomeScheduled)
+	if s.busy > s.shedFreePeak {
+		s.shedFreePeak = s.busy
+	}
+
+	s.serveFair(j.fairID)
+	s.recordStatus(j)
+	s.forgetDedup(j)
+	j.running = true
+	j.holders = int32(1 + len(j.followers))
+	j.started = time.Now()
+	if s.debug {
+		s.held = append(s.held, j)
+	}
+
+	if s.options.Reporter != nil {
+		s.options.Reporter.JobScheduled(j.meta)
+	}
+
+	if s.options.OnSchedule != nil {
+		s.options.OnSchedule(j.meta)
+	}
+
+	j.notify <- nil
+	for _, f := range j.followers {
+		f.notify <- nil
+	}
+}
+
+func (s *Stack) reject(j *job, err error) {
+	s.unschedule(j)
+	s.finishMirror(j)
+	dropped, timedOut := errors.Is(err, ErrStackFull), errors.Is(err, ErrTimeout)
+	switch {
+	case dropped:
+		s.total.Dropped++
+		s.delta.Dropped++
+		if errors.Is(err, ErrEvictedByReconfigure) {
+			s.total.DroppedByReconfigure++
+			s.delta.DroppedByReconfigure++
+		} else {
+			s.total.DroppedByOverload++
+			s.delta.DroppedByOverload++
+		}
+
+		s.recordOutcome(outcomeDropped)
+	case timedOut:
+		s.total.TimedOut++
+		s.delta.TimedOut++
+		s.recordOutcome(outcomeTimedOut)
+	}
+
+	if dropped || timedOut {
+		s.endShedFree()
+		s.lastShed = s.now()
+		if j == s.probe {
+			s.openBreaker(time.Now())
+		} else {
+			s.recordShed()
+		}
+	} else {
+		s.leaveProbe(j)
+	}
+
+	s.recordStatus(j)
+	s.forgetDedup(j)
+	if s.options.Reporter != nil {
+		s.options.Reporter.JobDropped(j.meta, err)
+	}
+
+	j.notify <- err
+	for _, f := range j.followers {
+		f.notify <- err
+	}
+}
+
+// measure updates the moving average of the execution time with a finished
+// job.
+func (s *Stack) measure(j *job) {
+	d := time.Since(j.started)
+	if s.options.SlowThreshold > 0 && d > s.options.SlowThreshold {
+		s.slowJobs++
+		if s.options.OnSlowJob != nil {
+			s.options.OnSlowJob(d)
+		}
+	}
+
+	if s.avgRun == 0 {
+		s.avgRun = d
+		return
+	}
+
+	s.avgRun = (7*s.avgRun + d) / 8
+}
+
+// estimatedWait estimates how long a new job would wait in the stack, based on
+// the number of the queued jobs, the concurrency level and the average
+// execution time of the recently finished jobs.
+func (s *Stack) estimatedWait() time.Duration {
+	return time.Duration(s.stack.size()) * s.avgRun / time.Duration(s.options.MaxConcurrency)
+}
+
+// failFast tells whether a job that needs to be queued should be rejected,
+// because it would likely time out anyway.
+func (s *Stack) failFast() bool {
+	if !s.options.FailFastOnTimeout || s.options.Timeout <= 0 {
+		return false
+	}
+
+	return s.estimatedWait() > s.options.Timeout
+}
+
+// closedErr returns the error for the jobs submitted after the stack was
+// closed.
+func (s *Stack) closedErr() error {
+	if s.standby != nil {
+		return &RedirectError{Standby: s.standby}
+	}
+
+	return ErrClosed
+}
+
+// handOver moves the queued jobs to the standby stack, when set.
+func (s *Stack) handOver() {
+	if s.standby == nil {
+		return
+	}
+
+	s.handOverTo(s.standby)
+}
+
+// handOverTo moves the queued jobs to another stack. The jobs are sent from a
+// separate goroutine, so that the control loop doesn't block on the other
+// stack, even when the two stacks are closed at the same time, handing over
+// the jobs to each other. Until the other stack received the jobs, the
+// current stack doesn't quit, and if the other stack was closed in the
+// meantime, the jobs receive ErrClosedWhileQueued.
+func (s *Stack) handOverTo(to *Stack) {
+	if s.stack.empty() {
+		return
+	}
+
+	var jobs []*job
+	for !s.stack.empty() {
+		j := s.stack.shift()
+		s.leaveProbe(j)
+		s.unschedule(j)
+		j.setOwner(to)
+		jobs = append(jobs, j)
+	}
+
+	s.handingOver++
+	go func() {
+		select {
+		case to.adopt <- jobs:
+			s.call(func() { s.handingOver-- })
+		case <-to.hasQuit:
+			if !s.call(func() {
+				s.handingOver--
+				for _, j := range jobs {
+					j.setOwner(s)
+					s.reject(j, ErrClosedWhileQueued)
+				}
+			}) {
+				// the current stack was closed with CloseForced, or its
+				// close timeout expired:
+				for _, j := range jobs {
+					j.notify <- ErrClosedWhileQueued
+					for _, f := range j.followers {
+						f.notify <- ErrClosedWhileQueued
+					}
+				}
+			}
+		}
+	}()
+}
+
+// admit handles an incoming job.
+func (s *Stack) admit(j *job) {
+	if s.closing {
+		s.reject(j, s.closedErr())
+	} else if s.busy < s.limit() {
+		s.schedule(j)
+	} else if j.noQueue {
+		s.reject(j, ErrStackFull)
+	} else if j.limitBacklog && s.stack.size() >= j.maxBacklog {
+		s.reject(j, ErrBacklogTooDeep)
+	} else if s.options.Admit != nil && !s.options.Admit(j.meta, s.snapshot()) {
+		s.reject(j, ErrAdmissionDenied)
+	} else if s.failFast() {
+		s.reject(j, ErrTimeout)
+	} else if s.oversize(j) {
+		s.reject(j, ErrStackFull)
+	} else {
+		if s.stack.full() && s.scheduler == nil {
+			if s.options.EvictOrder == EvictNewest {
+				s.reject(j, ErrStackFull)
+				return
+			}
+
+			oldest := s.stack.shift()
+			s.reject(oldest, ErrStackFull)
+		}
+
+		j.queued = true
+		s.queue(j)
+		if j.dedupKey != "" {
+			if s.dedup == nil {
+				s.dedup = make(map[string]*job)
+			}
+
+			s.dedup[j.dedupKey] = j
+		}
+
+		s.shedOverflow(ErrStackFull)
+		s.shedBytes(ErrStackFull)
+		s.recordStatus(j)
+	}
+}
+
+// attach links a job submitted with WaitDedup to the queued job with the same
+// key, if there is one.
+func (s *Stack) attach(j *job) bool {
+	if j.dedupKey == "" || s.closing {
+		return false
+	}
+
+	leader, ok := s.dedup[j.dedupKey]
+	if !ok {
+		return false
+	}
+
+	if !leader.stacked || leader.getOwner() != s {
+		delete(s.dedup, j.dedupKey)
+		return false
+	}
+
+	j.queued = true
+	j.leader = leader
+	leader.followers = append(leader.followers, j)
+	return true
+}
+
+// forgetDedup stops attaching new jobs to a job leaving the stack.
+func (s *Stack) forgetDedup(j *job) {
+	if j.dedupKey != "" && s.dedup[j.dedupKey] == j {
+		delete(s.dedup, j.dedupKey)
+	}
+}
+
+// recordStatus stores the status of the stack in a job submitted with
+// WaitWithStatus, when the job is handled the first time.
+func (s *Stack) recordStatus(j *job) {
+	if !j.withStatus || j.hasStatus {
+		return
+	}
+
+	j.status = s.snapshot()
+	j.hasStatus = true
+}
+
+// sizeJob measures the size of the metadata of a job, with the SizeOf option.
+func (s *Stack) sizeJob(j *job) {
+	j.size = 0
+	if s.options.SizeOf != nil {
+		j.size = s.options.SizeOf(j.meta)
+	}
+}
+
+// oversize measures the size of a job to be queued, and tells whether it
+// exceeds MaxQueuedBytes on its own.
+func (s *Stack) oversize(j *job) bool {
+	s.sizeJob(j)
+	return s.options.MaxQueuedBytes > 0 && j.size > s.options.MaxQueuedBytes
+}
+
+// shedOverflow drops the queued jobs with err, while their number exceeds
+// MaxStackSize.
+func (s *Stack) shedOverflow(err error) {
+	for s.stack.cap > 0 && s.stack.size() > s.stack.cap {
+		s.reject(s.evict(), err)
+	}
+}
+
+// shedBytes drops the queued jobs with err, while their total size exceeds
+// MaxQueuedBytes.
+func (s *Stack) shedBytes(err error) {
+	for s.options.MaxQueuedBytes > 0 && s.stack.bytes > s.options.MaxQueuedBytes {
+		s.reject(s.evict(), err)
+	}
+}
+
+// snapshot returns the current status of the stack, from the control loop.
+func (s *Stack) snapshot() Status {
+	return Status{
+		ActiveJobs:       s.busy,
+		QueuedJobs:       s.stack.size(),
+		QueuedBytes:      s.stack.bytes,
+		SlowJobs:         s.slowJobs,
+		Closing:          s.closing,
+		Paused:           s.paused,
+		Breaker:          s.breaker,
+		Reconfigurations: s.reconfigurations,
+		LastReconfigure:  s.lastReconfigure,
+
+		DroppedByOverload:    s.total.DroppedByOverload,
+		DroppedByReconfigure: s.total.DroppedByReconfigure,
+	}
+}
+
+// limit returns the number of jobs that can be active at the moment.
+func (s *Stack) limit() int {
+	if s.paused {
+		return 0
+	}
+
+	l := s.options.MaxConcurrency
+	if s.boost > l {
+		l = s.boost
+	}
+
+	if max := s.options.MaxTotalJobs; max > 0 {
+		if remaining := s.busy + max - s.total.Scheduled; remaining < l {
+			l = remaining
+		}
+	}
+
+	return l
+}
+
+// fill schedules queued jobs while there are free slots.
+func (s *Stack) fill() {
+	for s.busy < s.limit() && !s.stack.empty() {
+		s.schedule(s.next())
+	}
+}
+
+// adoptJobs takes over jobs queued in another stack, preserving their order.
+// The adopted jobs are placed below the jobs already queued, since they were
+// submitted earlier, and this way their timeouts are watched first. The free
+// slots are filled first, and the jobs that still don't fit are dropped,
+// starting with the oldest.
+func (s *Stack) adoptJobs(jobs []*job) {
+	for i := len(jobs) - 1; i >= 0; i-- {
+		j := jobs[i]
+		if j.timeout == nil && s.options.Timeout > 0 {
+			j.timeout = time.After(s.options.Timeout)
+		}
+
+		if s.closing {
+			s.reject(j, ErrClosedWhileQueued)
+			continue
+		}
+
+		s.sizeJob(j)
+		s.stack.unshift(j)
+	}
+
+	for _, j := range jobs {
+		if j.stacked {
+			s.pushScheduler(j)
+		}
+	}
+
+	s.fill()
+	s.shedOverflow(ErrStackFull)
+	s.shedBytes(ErrStackFull)
+}
+
+// graceTimeout extends the timeout of the oldest queued job, when a running job
+// signaled that it is finishing. It extends the timeout of a job only once.
+func (s *Stack) graceTimeout(j *job) bool {
+	if s.options.TimeoutGrace <= 0 || s.finishing == 0 || j.graced {
+		return false
+	}
+
+	j.graced = true
+	j.timeout = time.After(s.options.TimeoutGrace)
+	s.graced = j
+	return true
+}
+
+// closeWithin sets the deadline of the teardown, unless an earlier deadline
+// was already set.
+func (s *Stack) closeWithin(d time.Duration) {
+	deadline := time.Now().Add(d)
+	if s.closeTimeout != nil && !deadline.Before(s.closeDeadline) {
+		return
+	}
+
+	s.closeDeadline = deadline
+	s.closeTimeout = time.After(d)
+}
+
+// woke records the time the control loop spent blocked, and the start of
+// handling an event, when the loop instrumentation is enabled.
+func (s *Stack) woke(spent *time.Duration) {
+	if !s.options.InstrumentLoop {
+		return
+	}
+
+	s.loopWoke = time.Now()
+	if !s.loopStarted.IsZero() {
+		s.loopStats.Blocked += s.loopWoke.Sub(s.loopStarted)
+	}
+
+	s.loopSpent = spent
+}
+
+// handled records the time the control loop spent handling an event, when
+// the loop instrumentation is enabled.
+func (s *Stack) handled() {
+	if s.loopSpent != nil {
+		*s.loopSpent += time.Since(s.loopWoke)
+		s.loopSpent = nil
+	}
+
+	if s.options.InstrumentLoop {
+		s.loopStarted = time.Now()
+	} else {
+		s.loopStarted = time.Time{}
+	}
+}
+
+func (s *Stack) applyOptions(o Options) {
+	if o.MaxConcurrency <= 0 {
+		o.MaxConcurrency = 1
+	}
+
+	s.accountBusy()
+	old := s.options
+	if o.Reporter != old.Reporter {
+		s.setReporterLabels(o.Reporter)
+	}
+
+	s.options = o
+	s.stack.cap = o.MaxStackSize
+	s.stack.trackDepths = o.TrackQueueDepth
+	s.reconfigurations++
+	s.lastReconfigure = time.Now()
+
+	s.fill()
+	s.shedOverflow(ErrEvictedByReconfigure)
+	s.shedBytes(ErrEvictedByReconfigure)
+
+	if o.OnReconfigure != nil {
+		o.OnReconfigure(old, o)
+	}
+}
+
+func (s *Stack) accept(j *job) {
+	if s.attach(j) {
+		return
+	}
+
+	s.mirror(j)
+
+	if !s.closing && s.breakerOpen(j) {
+		s.reject(j, ErrCircuitOpen)
+	} else {
+		s.admit(j)
+	}
+}
+
+// mirror submits a copy of the job to the shadow stack, when set. The copy
+// holds its slot in the shadow stack until the original job leaves the stack.
+func (s *Stack) mirror(j *job) {
+	sh := s.shadow
+	if sh == nil {
+		return
+	}
+
+	m := sh.newJob()
+	m.meta = j.meta
+	m.estimate = j.estimate
+	m.fairID = j.fairID
+	m.weight = j.weight
+	select {
+	case sh.req <- m:
+	case <-sh.hasQuit:
+		return
+	}
+
+	finished := make(chan struct{})
+	j.mirrored = finished
+	go func() {
+		select {
+		case err := <-m.notify:
+			if err != nil {
+				return
+			}
+		case <-sh.hasQuit:
+			return
+		}
+
+		select {
+		case <-finished:
+			sh.release(m)
+		case <-sh.hasQuit:
+		}
+	}()
+}
+
+// notifyDepth releases the callers of WaitBelowDepth whose target depth was
+// reached.
+func (s *Stack) notifyDepth() {
+	for c, target := range s.depthWait {
+		if s.stack.size() <= target {
+			close(c)
+			delete(s.depthWait, c)
+		}
+	}
+}
+
+// accountBusy accumulates the time weighted number of the running jobs and of
+// the available slots, since the last change.
+func (s *Stack) accountBusy() {
+	now := s.now()
+	d := float64(now.Sub(s.busyAt))
+	s.busyTime += float64(s.busy) * d
+	s.capacityTime += float64(s.options.MaxConcurrency) * d
+	s.busyAt = now
+}
+
+func (s *Stack) unhold(j *job) {
+	for i, h := range s.held {
+		if h == j {
+			s.held = append(s.held[:i], s.held[i+1:]...)
+			return
+		}
+	}
+}
+
+func formatTrace(pc []uintptr) string {
+	if len(pc) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	frames := runtime.CallersFrames(pc)
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			return b.String()
+		}
+	}
+}
+
+func (s *Stack) finishMirror(j *job) {
+	if j.mirrored != nil {
+		close(j.mirrored)
+		j.mirrored = nil
+	}
+}
+
+func (s *Stack) closeShadow() {
+	if s.shadow != nil {
+		s.shadow.CloseForced()
+		s.shadow = nil
+	}
+}
+
+func (s *Stack) sequenceTimeout() time.Duration {
+	if s.options.SequenceTimeout <= 0 {
+		return 100 * time.Millisecond
+	}
+
+	return s.options.SequenceTimeout
+}
+
+// sequence holds back the jobs submitted with WaitSeq, until the jobs with the
+// preceding sequence numbers arrive.
+func (s *Stack) sequence(j *job) {
+	if _, pending := s.seqPending[j.seq]; pending || j.seq < s.nextSeq {
+		s.accept(j)
+		return
+	}
+
+	if s.seqPending == nil {
+		s.seqPending = make(map[uint64]*job)
+	}
+
+	s.seqPending[j.seq] = j
+	s.releaseSequenced()
+}
+
+// releaseSequenced accepts the held back jobs that are next in the sequence.
+func (s *Stack) releaseSequenced() {
+	from := s.nextSeq
+	for {
+		j, ok := s.seqPending[s.nextSeq]
+		if !ok {
+			break
+		}
+
+		delete(s.seqPending, s.nextSeq)
+		s.nextSeq++
+		s.accept(j)
+	}
+
+	if len(s.seqPending) == 0 {
+		s.seqTimeout = nil
+	} else if s.seqTimeout == nil || s.nextSeq != from {
+		s.seqTimeout = time.After(s.sequenceTimeout())
+	}
+}
+
+// skipSequence gives up waiting for the missing sequence numbers before the
+// lowest held back one.
+func (s *Stack) skipSequence() {
+	first := true
+	for seq := range s.seqPending {
+		if first || seq < s.nextSeq {
+			s.nextSeq = seq
+			first = false
+		}
+	}
+
+	s.releaseSequenced()
+}
+
+// flushSequenced accepts all the held back jobs, in the order of their
+// sequence numbers.
+func (s *Stack) flushSequenced() {
+	for len(s.seqPending) > 0 {
+		s.skipSequence()
+	}
+}
+
+func (s *Stack) run() {
+	defer s.closeShadow()
+	for {
+		var timeout <-chan time.Time
+		oldest := s.stack.bottom()
+		if oldest != nil {
+			timeout = oldest.timeout
+		}
+
+		select {
+		case j := <-s.req:
+			s.woke(&s.loopStats.Submit)
+			j.submitted = time.Now()
+			if s.options.Timeout > 0 {
+				j.timeout = time.After(s.options.Timeout)
+			}
+
+			if j.sequenced && !s.closing {
+				s.sequence(j)
+			} else {
+				s.accept(j)
+			}
+		case jobs := <-s.adopt:
+			s.woke(&s.loopStats.Adopt)
+			s.adoptJobs(jobs)
+		case j := <-s.done:
+			s.woke(&s.loopStats.Done)
+			s.accountBusy()
+			s.busy--
+			j.running = false
+			s.finishMirror(j)
+			s.unhold(j)
+			if j.finishing {
+				j.finishing = false
+				s.finishing--
+			}
+			s.total.Completed++
+			s.delta.Completed++
+			s.measure(j)
+			if s.options.Reporter != nil {
+				s.options.Reporter.JobDone(j.meta)
+			}
+
+			if s.options.OnDone != nil {
+				s.options.OnDone(j.meta, time.Since(j.started))
+			}
+
+			if !s.stack.empty() && s.busy < s.limit() {
+				s.schedule(s.next())
+			}
+		case c := <-s.cancel:
+			s.woke(&s.loopStats.Cancel)
+			removed := c.job.getOwner() == s && c.job.stacked
+			if removed {
+				s.stack.remove(c.job)
+				s.unschedule(c.job)
+				s.leaveProbe(c.job)
+				s.finishMirror(c.job)
+			}
+
+			c.removed <- removed
+		case <-timeout:
+			s.woke(&s.loopStats.Timeout)
+			if !s.graceTimeout(oldest) {
+				s.reject(oldest, &TimeoutError{Waited: time.Since(oldest.submitted)})
+				s.stack.shift()
+			}
+		case status := <-s.status:
+			s.woke(&s.loopStats.Status)
+			status <- s.snapshot()
+		case o := <-s.reconfigure:
+			s.woke(&s.loopStats.Reconfigure)
+			s.applyOptions(o)
+		case f := <-s.calls:
+			s.woke(&s.loopStats.Call)
+			f()
+		case mode := <-s.quit:
+			s.woke(&s.loopStats.Quit)
+			if mode == closeForced {
+				s.flushSequenced()
+				s.handOver()
+				s.rejectQueued()
+				s.exit()
+				return
+			}
+
+			s.beginClose(mode)
+		case <-s.lifetime:
+			s.woke(&s.loopStats.Quit)
+			s.lifetime = nil
+			s.beginClose(closeGraceful)
+		case <-s.seqTimeout:
+			s.woke(&s.loopStats.Submit)
+			s.skipSequence()
+		case <-s.boostTimeout:
+			s.woke(&s.loopStats.Reconfigure)
+			s.boost = 0
+			s.boostTimeout = nil
+		case <-s.closeTimeout:
+			s.woke(&s.loopStats.Quit)
+			s.rejectQueued()
+			s.exit()
+			return
+		}
+
+		s.handled()
+		if s.options.MaxTotalJobs > 0 && s.total.Scheduled >= s.options.MaxTotalJobs && !s.closing {
+			s.beginClose(closeDrainRunning)
+		}
+
+		s.notifyDepth()
+		idle := s.busy == 0 && s.stack.empty() && len(s.seqPending) == 0 && s.handingOver == 0
+		if idle && !s.idle && s.options.OnDrained != nil {
+			s.options.OnDrained()
+		}
+
+		s.idle = idle
+		if s.closing && idle {
+			s.exit()
+			return
+		}
+
+		if s.snapshotStatus {
+			s.statusSnapshot.Store(s.snapshot())
+		}
+
+		atomic.StoreInt64(&s.lastActivity, s.now().UnixNano())
+	}
+}
+
+// exit signals that the control loop has quit, and rejects the jobs left in
+// the intake buffer.
+func (s *Stack) exit() {
+	close(s.hasQuit)
+	if cap(s.req) > 0 {
+		go s.drainIntake()
+	}
+}
+
+// drainIntake rejects the buffered jobs, until no caller is submitting
+// anymore. The callers don't submit to the buffer after the loop has quit.
+func (s *Stack) drainIntake() {
+	err := s.closedErr()
+	for {
+		select {
+		case j := <-s.req:
+			j.notify <- err
+		default:
+			if atomic.LoadInt64(&s.blockedWaiters) == 0 && len(s.req) == 0 {
+				return
+			}
+
+			runtime.Gosched()
+		}
+	}
+}
+
+// beginClose stops accepting new jobs, and lets the queued and the active jobs
+// drain.
+func (s *Stack) beginClose(mode closeMode) {
+	s.flushSequenced()
+	s.handOver()
+	s.closing = true
+	if mode == closeDrainRunning {
+		s.rejectQueued()
+	}
+
+	s.paused = false
+	s.fill()
+
+	if s.options.CloseTimeout > 0 {
+		s.closeWithin(s.options.CloseTimeout)
+	}
+}
+
+// call executes f in the control loop, and returns when it's done. It returns
+// false when the stack was already closed, without executing f.
+func (s *Stack) call(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case s.calls <- func() { f(); close(done) }:
+		<-done
+		return true
+	case <-s.hasQuit:
+		return false
+	}
+}
+
+func (s *Stack) newJob() *job {
+	j := &job{notify: make(chan error)}
+	j.setOwner(s)
+	return j
+}
+
+// getOwner returns the stack holding the job. It can change when the job is
+// moved to another stack.
+func (j *job) getOwner() *Stack {
+	return j.owner.Load().(*Stack)
+}
+
+func (j *job) setOwner(s *Stack) {
+	j.owner.Store(s)
+}
+
+// respawn creates a new job for submitting a rejected job to another stack,
+// with the same parameters.
+func (j *job) respawn(to *Stack) *job {
+	n := to.newJob()
+	n.meta = j.meta
+	n.estimate = j.estimate
+	n.weight = j.weight
+	n.limitBacklog = j.limitBacklog
+	n.maxBacklog = j.maxBacklog
+	n.noQueue = j.noQueue
+	n.fairID = j.fairID
+	n.withStatus = j.withStatus
+	n.dedupKey = j.dedupKey
+	n.trace = j.trace
+	return n
+}
+
+// abandon removes a waiting job from the stack currently holding it. If the
+// job gets notified in the meantime, it returns the received result.
+func (j *job) abandon() (removed bool, err error) {
+	for {
+		owner := j.getOwner()
+		c := cancelRequest{job: j, removed: make(chan bool, 1)}
+		select {
+		case owner.cancel <- c:
+			if <-c.removed {
+				return true, nil
+			}
+		case err = <-j.notify:
+			return false, err
+		case <-owner.hasQuit:
+		}
+	}
+}
+
+// Wait returns when a job can be processed, or it should be cancelled. The notion of
+// the actual 'job' to be processed is completely up to the calling code.
+//
+// When a job can be processed, Wait returns a non-nil done() function, which must be
+// called after the job was done, in order to free-up a slot for the next job.
+//
+// When the job needs to be droppped, Wait returns ErrStackFull. When the job timed out,
+// Wait returns an error matching ErrTimeout with errors.Is, see TimeoutWaited. In these
+// cases, done() must not be called, and it may be nil.
+//
+// When the stack was already closed, Wait returns ErrClosed. When the stack was closed
+// while the job was waiting in it, Wait returns ErrClosedWhileQueued, which also matches
+// ErrClosed with errors.Is.
+//
+// When the circuit breaker of the stack is open, Wait returns ErrCircuitOpen. When the
+// Admit option rejects the job, Wait returns ErrAdmissionDenied. When the stack was closed
+// after registering a standby with Failover, Wait returns a *RedirectError, instead of
+// ErrClosed.
+func (s *Stack) Wait() (done func(), err error) {
+	return s.wait(context.Background(), s.newJob())
+}
+
+// WaitMeta is like Wait, but it accepts arbitrary metadata that identifies the
+// job, e.g. for tagging metrics. The metadata is passed to the Reporter.
+func (s *Stack) WaitMeta(meta interface{}) (done func(), err error) {
+	j := s.newJob()
+	j.meta = meta
+	return s.wait(context.Background(), j)
+}
+
+// TryWait is like Wait, but it never queues the job: when no slot is free, it
+// returns ErrStackFull immediately. The rejected job is counted as dropped.
+func (s *Stack) TryWait() (done func(), err error) {
+	j := s.newJob()
+	j.noQueue = true
+	return s.wait(context.Background(), j)
+}
+
+// WaitUnlessBacklog is like Wait, but when no slot is free, and there are
+// already at least max jobs queued, it returns ErrBacklogTooDeep immediately,
+// instead of queueing the job.
+func (s *Stack) WaitUnlessBacklog(max int) (done func(), err error) {
+	j := s.newJob()
+	j.limitBacklog = true
+	j.maxBacklog = max
+	return s.wait(context.Background(), j)
+}
+
+// WaitFair is like Wait, but it accepts an identity of the caller, e.g. a
+// client or tenant name. When a slot frees up, the stack schedules a queued job
+// of the identity that was scheduled the least recently, so the identities
+// with queued jobs take turns, in a round-robin fashion. This way callers
+// resubmitting jobs in a tight loop cannot starve the other callers. The jobs
+// submitted with Wait have an empty identity.
+//
+// Finding the next job in this case requires scanning the stack, which has a
+// cost linear to the number of the queued jobs. The stack remembers the
+// identities it has scheduled, up to a limit of 1024, beyond which it forgets
+// the ones without queued jobs.
+func (s *Stack) WaitFair(id string) (done func(), err error) {
+	j := s.newJob()
+	j.fairID = id
+	return s.wait(context.Background(), j)
+}
+
+// WaitSeq is like Wait, but it accepts a sequence number, and the stack
+// accepts the jobs submitted with WaitSeq in the order of their sequence
+// numbers, regardless of the order in which the calling goroutines arrive. The
+// sequence starts from zero. A job that arrives before the preceding ones is
+// held back until they arrive, but at most for the SequenceTimeout, after
+// which the missing sequence numbers are skipped. The jobs with an already
+// passed or a duplicate sequence number are accepted immediately.
+//
+// Combined with ScheduleFIFO and MaxConcurrency of 1, it guarantees that the
+// jobs are executed in the sequence order. The held back jobs are not counted
+// in QueuedJobs, and they don't time out while held back.
+func (s *Stack) WaitSeq(n uint64) (done func(), err error) {
+	j := s.newJob()
+	j.sequenced = true
+	j.seq = n
+	return s.wait(context.Background(), j)
+}
+
+// WaitDedup is like Wait, but it accepts a key identifying the work of the job.
+// When a job with the same key is already queued, the new job is not queued
+// again, but it gets attached to the queued one, and both callers receive the
+// same result, at the same time. The attached jobs occupy only a single slot.
+// Every caller needs to call its own done() function, and the slot is released
+// when the last one of them did. The attached jobs are not counted in
+// QueuedJobs, and they are not passed to the Reporter or the callbacks.
+func (s *Stack) WaitDedup(key string) (done func(), err error) {
+	j := s.newJob()
+	j.dedupKey = key
+	if _, j, err = s.waitJob(context.Background(), j); err != nil {
+		return func() {}, err
+	}
+
+	leader := j
+	if j.leader != nil {
+		leader = j.leader
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if atomic.AddInt32(&leader.holders, -1) == 0 {
+				leader.getOwner().release(leader)
+			}
+		})
+	}, nil
+}
+
+// WaitEstimate is like Wait, but it accepts the expected duration of the job.
+// The estimate is used when the ShortestJobFirst option is set.
+func (s *Stack) WaitEstimate(d time.Duration) (done func(), err error) {
+	j := s.newJob()
+	j.estimate = d
+	return s.wait(context.Background(), j)
+}
+
+// WaitWeight is like Wait, but it accepts the weight of the job, used by the
+// WeightedFair scheduler, see the Scheduler option. Without a scheduler using
+// it, the weight has no effect.
+func (s *Stack) WaitWeight(w int) (done func(), err error) {
+	j := s.newJob()
+	j.weight = w
+	return s.wait(context.Background(), j)
+}
+
+// WaitContext is like Wait, but it gives up waiting when the context is
+// canceled, and returns the error of the context. When the job was already
+// waiting in the stack, it gets removed from it.
+func (s *Stack) WaitContext(ctx context.Context) (done func(), err error) {
+	return s.wait(ctx, s.newJob())
+}
+
+// WaitGrant contains the result of waiting with WaitChan.
+type WaitGrant struct {
+
+	// Done needs to be called after the job was done, when Err is nil, the
+	// same way as the done() function returned by Wait.
+	Done func()
+
+	// Err contains the error of waiting, the same way as returned by Wait.
+	Err error
+}
+
+// WaitChan is like Wait, but instead of blocking, it returns a channel, that
+// delivers a single WaitGrant when the stack has decided about the job, and
+// then it gets closed. This way waiting for a slot can be combined with other
+// channels in a select statement.
+//
+// When the caller is not interested in the grant anymore, it must call the
+// returned cancel function, otherwise the job may hold a slot that is never
+// released. After cancel was called, the job is removed from the stack, or,
+// if it was already scheduled, but the grant was not received, the slot gets
+// released by the stack. Once the grant was received, cancel has no effect,
+// and the slot needs to be released by calling Done. It is safe to call
+// cancel multiple times.
+func (s *Stack) WaitChan() (grant <-chan WaitGrant, cancel func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan WaitGrant)
+	go func() {
+		defer close(c)
+		done, err := s.WaitContext(ctx)
+		select {
+		case c <- WaitGrant{Done: done, Err: err}:
+		case <-ctx.Done():
+			if err == nil {
+				done()
+			}
+		}
+	}()
+
+	return c, cancel
+}
+
+func (s *Stack) wait(ctx context.Context, j *job) (done func(), err error) {
+	done, _, err = s.waitJob(ctx, j)
+	return
+}
+
+// waitJob is like wait, but it also returns the job that got scheduled or
+// rejected, which is a different one when the job spilled over to the
+// SpillOnFull stack.
+func (s *Stack) waitJob(ctx context.Context, j *job) (done func(), used *job, err error) {
+	if s.debug && j.trace == nil {
+		pc := make([]uintptr, 32)
+		j.trace = pc[:runtime.Callers(2, pc)]
+	}
+
+	atomic.AddInt64(&s.blockedWaiters, 1)
+	req := s.req
+	if cap(req) > 0 {
+		// the buffer would accept the job also after the loop has quit
+		select {
+		case <-s.hasQuit:
+			req = nil
+		default:
+		}
+	}
+
+	select {
+	case req <- j:
+		atomic.AddInt64(&s.blockedWaiters, -1)
+		select {
+		case err = <-j.notify:
+		case <-ctx.Done():
+			var removed bool
+			if removed, err = j.abandon(); removed {
+				err = ctx.Err()
+			}
+		}
+
+		if err != nil {
+			done = func() {}
+		} else {
+			done = func() { j.getOwner().release(j) }
+		}
+	case <-s.hasQuit:
+		atomic.AddInt64(&s.blockedWaiters, -1)
+		err = s.closedErr()
+	case <-ctx.Done():
+		atomic.AddInt64(&s.blockedWaiters, -1)
+		err = ctx.Err()
+		done = func() {}
+	}
+
+	err = s.err(err)
+	if s.spill != nil && s.spill != s && errors.Is(err, ErrStackFull) {
+		return s.spill.waitJob(ctx, j.respawn(s.spill))
+	}
+
+	return done, j, err
+}
+
+func (s *Stack) err(err error) error {
+	if err == nil || s.name == "" {
+		return err
+	}
+
+	return &Error{Name: s.name, Err: err}
+}
+
+func (s *Stack) release(j *job) bool {
+	atomic.AddInt64(&s.pendingReleases, 1)
+	defer atomic.AddInt64(&s.pendingReleases, -1)
+
+	var timeout <-chan time.Time
+	if s.releaseTimeout > 0 {
+		t := time.NewTimer(s.releaseTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case s.done <- j:
+		return true
+	case <-s.hasQuit:
+		return false
+	case <-timeout:
+		atomic.AddInt64(&s.abandonedReleases, 1)
+		return false
+	}
+}
+
+// WaitAck is like Wait, but the returned done() function reports whether
+// calling it actually freed up a slot in the stack. It returns false when the
+// stack was already closed, e.g. with CloseForced, and the release was
+// ignored.
+func (s *Stack) WaitAck() (done func() bool, err error) {
+	_, j, err := s.waitJob(context.Background(), s.newJob())
+	if err != nil {
+		return func() bool { return false }, err
+	}
+
+	return func() bool { return j.getOwner().release(j) }, nil
+}
+
+// WaitFinishing is like Wait, but it also returns a finishing() function, that
+// the job can call to signal that it is about to call done(), e.g. when it is
+// known to be in its final step. When the TimeoutGrace option is set, the stack
+// can extend the timeout of the oldest queued job in the meantime, instead of
+// dropping it right before the slot frees up. Calling finishing() before the
+// job was scheduled, after done(), or multiple times has no effect.
+func (s *Stack) WaitFinishing() (done func(), finishing func(), err error) {
+	done, j, err := s.waitJob(context.Background(), s.newJob())
+	if err != nil {
+		return done, func() {}, err
+	}
+
+	owner := j.getOwner()
+	finishing = func() {
+		owner.call(func() {
+			if j.running && !j.finishing {
+				j.finishing = true
+				owner.finishing++
+			}
+		})
+	}
+
+	return done, finishing, nil
+}
+
+// Submit is like Wait, but it also reports whether the job could be scheduled
+// immediately. When scheduled is true, the job could be started without
+// waiting. When scheduled is false and err is nil, the job had to wait in the
+// stack before it could be started. When err is not nil, the job was dropped
+// or timed out, the same way as with Wait.
+func (s *Stack) Submit() (scheduled bool, done func(), err error) {
+	done, j, err := s.waitJob(context.Background(), s.newJob())
+	scheduled = err == nil && !j.queued
+	return
+}
+
+// WaitWithStatus is like Wait, but it also returns the status of the stack at
+// the moment when the control loop handled the job: when the job was scheduled,
+// queued or rejected. This way the caller can learn the effect of the
+// submission without a separate call to Status, that could observe the
+// changes caused by other jobs in between. When the stack was already closed,
+// the returned status has only the Closed field set.
+func (s *Stack) WaitWithStatus() (done func(), status Status, err error) {
+	j := s.newJob()
+	j.withStatus = true
+	done, j, err = s.waitJob(context.Background(), j)
+	if !j.hasStatus {
+		status = Status{Closed: true}
+	} else {
+		status = j.status
+	}
+
+	status.PendingReleases = int(atomic.LoadInt64(&s.pendingReleases))
+	status.BlockedWaiters = int(atomic.LoadInt64(&s.blockedWaiters))
+	status.AbandonedReleases = int(atomic.LoadInt64(&s.abandonedReleases))
+	return
 }
 
 // Do calls the job, as soon as the number of the running jobs is not higher than the
 // MaxConcurrency.
 //
 // If a job is dropped from the stack or times out, ErrStackFull or ErrTimeout is
-// returned. Do does not return any other errors than ErrStackFull or ErrTimeout.
+// returned. If the stack was closed, it returns ErrClosed.
 //
-// Once the job has been started, Do does not return an error.
+// Once the job has been started, Do does not return an error. When the job is
+// nil, Do returns ErrNilJob without occupying a slot.
 func (s *Stack) Do(job func()) error {
+	if job == nil {
+		return s.err(ErrNilJob)
+	}
+
 	done, err := s.Wait()
 	if err != nil {
-		return err
+		return err
+	}
+
+	job()
+	done()
+	return nil
+}
+
+// TryDo is like Do, but it executes the job only if it can be started
+// immediately, otherwise it returns ErrStackFull, see TryWait.
+func (s *Stack) TryDo(job func()) error {
+	if job == nil {
+		return s.err(ErrNilJob)
+	}
+
+	done, err := s.TryWait()
+	if err != nil {
+		return err
+	}
+
+	job()
+	done()
+	return nil
+}
+
+// DoReport is like Do, but it also reports whether the job had to wait in the
+// stack before it could be started. When err is not nil, the job was not
+// executed.
+func (s *Stack) DoReport(job func()) (queued bool, err error) {
+	if job == nil {
+		return false, s.err(ErrNilJob)
+	}
+
+	scheduled, done, err := s.Submit()
+	if err != nil {
+		return false, err
+	}
+
+	job()
+	done()
+	return !scheduled, nil
+}
+
+// DoDeadline is like Do, but it limits the total duration of waiting in the stack
+// and executing the job to d. If the job is not scheduled within d, it returns
+// ErrTimeout. If the job is scheduled, but it takes longer than the remaining
+// time, it returns ErrDeadlineExceeded. Otherwise it returns the error of the
+// job.
+//
+// The stack cannot interrupt the job, DoDeadline returns only after the job
+// has returned. Use DoDeadlineContext for jobs that can observe the deadline.
+func (s *Stack) DoDeadline(d time.Duration, job func() error) error {
+	if job == nil {
+		return s.err(ErrNilJob)
+	}
+
+	return s.DoDeadlineContext(d, func(context.Context) error { return job() })
+}
+
+// DoDeadlineContext is like DoDeadline, but it passes a context to the job that
+// gets canceled when the deadline is reached.
+func (s *Stack) DoDeadlineContext(d time.Duration, job func(ctx context.Context) error) error {
+	if job == nil {
+		return s.err(ErrNilJob)
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	done, err := s.WaitContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return s.err(&TimeoutError{Waited: time.Since(start)})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = job(ctx)
+	done()
+	if ctx.Err() != nil {
+		return s.err(ErrDeadlineExceeded)
+	}
+
+	return err
+}
+
+// withTimeout returns a context with the timeout d, or without a timeout when d
+// is not positive.
+func withTimeout(d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), d)
+}
+
+// DoPhased is like Do, but it limits the time spent waiting in the stack and
+// the time spent executing the job separately. If the job is not scheduled
+// within queueWait, DoPhased returns an error matching ErrTimeout. If the job
+// was scheduled, the context passed to it gets canceled after exec, and when
+// the job returns after that, DoPhased returns ErrExecutionTimeout. Otherwise
+// it returns the error of the job. When queueWait or exec is not positive,
+// the corresponding phase is not limited, apart from the Timeout option of the
+// stack.
+//
+// The stack cannot interrupt the job, it is up to the job to observe the
+// cancellation of the context.
+func (s *Stack) DoPhased(queueWait, exec time.Duration, job func(ctx context.Context) error) error {
+	if job == nil {
+		return s.err(ErrNilJob)
+	}
+
+	start := time.Now()
+	wctx, cancel := withTimeout(queueWait)
+	done, err := s.WaitContext(wctx)
+	cancel()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return s.err(&TimeoutError{Waited: time.Since(start)})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(exec)
+	defer cancel()
+	err = job(ctx)
+	done()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return s.err(ErrExecutionTimeout)
+	}
+
+	return err
+}
+
+// EstimatedWait returns how long a new job would wait in the stack, estimated
+// from the number of the queued jobs, the concurrency level and the average
+// execution time of the recently finished jobs. It returns zero when no job
+// has finished yet, or when the stack is closed.
+func (s *Stack) EstimatedWait() time.Duration {
+	var d time.Duration
+	s.call(func() { d = s.estimatedWait() })
+	return d
+}
+
+// DoOrRetryAfter is like Do, but when the job is dropped with ErrStackFull, it
+// also returns the estimated duration after which it makes sense to retry,
+// see EstimatedWait. When there is no estimate, it returns the average
+// execution time of the recently finished jobs.
+func (s *Stack) DoOrRetryAfter(job func()) (retryAfter time.Duration, err error) {
+	err = s.Do(job)
+	if errors.Is(err, ErrStackFull) {
+		s.call(func() {
+			retryAfter = s.estimatedWait()
+			if retryAfter == 0 {
+				retryAfter = s.avgRun
+			}
+		})
+	}
+
+	return retryAfter, err
+}
+
+// DoIfPrompt is like Do, but it executes the job only if it can be started
+// within the grace period. If the grace period passes first, the job is
+// removed from the stack, and DoIfPrompt returns false without an error, this
+// way the skipped stale jobs can be handled as a normal outcome. Otherwise it
+// returns the same errors as Do.
+func (s *Stack) DoIfPrompt(grace time.Duration, job func()) (ran bool, err error) {
+	if job == nil {
+		return false, s.err(ErrNilJob)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	done, err := s.WaitContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
 	}
 
 	job()
 	done()
-	return nil
+	return true, nil
+}
+
+// Reservation holds slots of a stack, reserved with Reserve.
+type Reservation struct {
+	stack *Stack
+	mx    sync.Mutex
+	slots int
+}
+
+// Reserve reserves n slots of the stack atomically, e.g. for a coordinated
+// operation consisting of interdependent jobs, that would deadlock if only
+// some of them could be scheduled. The reserved slots count as active jobs.
+// If there are not enough free slots, Reserve doesn't wait, and returns
+// ErrStackFull. If the stack was closed, it returns ErrClosed. When n <= 0, it
+// returns an error matching ErrInvalidOptions.
+//
+// The reserved slots can be used with the Run method of the returned
+// reservation, and the unused ones need to be freed with Release. The jobs
+// executed with Run don't count towards the MaxTotalJobs option.
+func (s *Stack) Reserve(n int) (*Reservation, error) {
+	if n <= 0 {
+		return nil, s.err(errReserveNonPositive)
+	}
+
+	var err error
+	if !s.call(func() {
+		if s.closing {
+			err = ErrClosed
+		} else if s.busy+n > s.limit() {
+			err = ErrStackFull
+		} else {
+			s.busy += n
+		}
+	}) {
+		err = ErrClosed
+	}
+
+	if err != nil {
+		return nil, s.err(err)
+	}
+
+	return &Reservation{stack: s, slots: n}, nil
+}
+
+func (s *Stack) unreserve(n int) {
+	s.call(func() {
+		s.busy -= n
+		s.fill()
+	})
+}
+
+// Run executes the job in the calling goroutine, using one of the reserved
+// slots, and frees the slot when the job returns. It can be called from
+// multiple goroutines. If there are no reserved slots left, it returns false
+// without executing the job.
+func (r *Reservation) Run(job func()) bool {
+	r.mx.Lock()
+	if r.slots == 0 {
+		r.mx.Unlock()
+		return false
+	}
+
+	r.slots--
+	r.mx.Unlock()
+	defer r.stack.unreserve(1)
+	job()
+	return true
+}
+
+// Release frees the unused reserved slots.
+func (r *Reservation) Release() {
+	r.mx.Lock()
+	n := r.slots
+	r.slots = 0
+	r.mx.Unlock()
+	if n > 0 {
+		r.stack.unreserve(n)
+	}
+}
+
+// ProcessAll executes the jobs received from the channel, each in its own
+// goroutine, limited by the stack. It returns when the channel is closed and
+// all the received jobs were either executed, dropped or timed out, returning
+// the number of each.
+func (s *Stack) ProcessAll(jobs <-chan func()) (processed, dropped, timedOut int) {
+	var (
+		wg sync.WaitGroup
+		mx sync.Mutex
+	)
+
+	for j := range jobs {
+		wg.Add(1)
+		go func(j func()) {
+			defer wg.Done()
+			err := s.Do(j)
+			mx.Lock()
+			defer mx.Unlock()
+			switch {
+			case err == nil:
+				processed++
+			case errors.Is(err, ErrStackFull):
+				dropped++
+			case errors.Is(err, ErrTimeout):
+				timedOut++
+			}
+		}(j)
+	}
+
+	wg.Wait()
+	return
+}
+
+// JobHandle identifies a job started with Go.
+type JobHandle struct {
+	cancel context.CancelFunc
+}
+
+// Go executes the job in a new goroutine, as soon as the number of the running
+// jobs is not higher than the MaxConcurrency. It returns immediately, and the
+// job is not executed if it gets dropped or timed out.
+//
+// The job receives a context that contains how long the job was waiting in
+// the stack, see WaitTimeFromContext, and the name of the stack, see
+// QueueNameFromContext. The context gets canceled when CancelJob is called
+// with the returned handle. If the job is still waiting in the stack at that
+// point, it is removed. The stack cannot stop a running job, it is up to
+// the job to observe the cancellation.
+//
+// When the job panics, and the PanicHandler option is set, the panic is
+// recovered and passed to the handler.
+//
+// A nil job is ignored.
+func (s *Stack) Go(job func(ctx context.Context)) *JobHandle {
+	if job == nil {
+		return &JobHandle{cancel: func() {}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		start := time.Now()
+		done, err := s.WaitContext(ctx)
+		if err != nil {
+			return
+		}
+
+		defer done()
+		if s.panicHandler != nil {
+			defer func() {
+				if r := recover(); r != nil {
+					s.panicHandler(r)
+				}
+			}()
+		}
+
+		ctx = context.WithValue(ctx, WaitTimeKey, time.Since(start))
+		job(context.WithValue(ctx, QueueNameKey, s.name))
+	}()
+
+	return &JobHandle{cancel: cancel}
+}
+
+// GoCallback is like Go, but instead of a context, it notifies the caller
+// about the completion of the job, by calling onComplete from the goroutine of
+// the job. It receives nil when the job was executed, or the reason when the
+// job was not executed, e.g. ErrStackFull or an error matching ErrTimeout.
+// When the job panics, and the PanicHandler option is set, onComplete receives
+// nil after the handler was called. A nil job is not executed, and onComplete
+// receives ErrNilJob. A nil onComplete is ignored.
+func (s *Stack) GoCallback(job func(), onComplete func(err error)) {
+	if onComplete == nil {
+		onComplete = func(error) {}
+	}
+
+	if job == nil {
+		onComplete(s.err(ErrNilJob))
+		return
+	}
+
+	go func() {
+		done, err := s.Wait()
+		if err != nil {
+			onComplete(err)
+			return
+		}
+
+		func() {
+			defer done()
+			if s.panicHandler != nil {
+				defer func() {
+					if r := recover(); r != nil {
+						s.panicHandler(r)
+					}
+				}()
+			}
+
+			job()
+		}()
+
+		onComplete(nil)
+	}()
+}
+
+// CancelJob cancels the context of a job started with Go.
+func (s *Stack) CancelJob(h *JobHandle) {
+	h.cancel()
 }
 
 // Status returns snapshot information about the state of the queue.
 func (s *Stack) Status() Status {
-	req := make(chan Status)
+	var status Status
+	if s.snapshotStatus {
+		select {
+		case <-s.hasQuit:
+			status = Status{Closed: true}
+		default:
+			status = s.statusSnapshot.Load().(Status)
+		}
+	} else {
+		req := make(chan Status)
+		select {
+		case <-s.hasQuit:
+			status = Status{Closed: true}
+		case s.status <- req:
+			status = <-req
+		}
+	}
+
+	status.PendingReleases = int(atomic.LoadInt64(&s.pendingReleases))
+	status.BlockedWaiters = int(atomic.LoadInt64(&s.blockedWaiters))
+	status.AbandonedReleases = int(atomic.LoadInt64(&s.abandonedReleases))
+	return status
+}
+
+// minHeartbeatInterval returns the shortest interval between the status reads
+// of the heartbeats, or zero when it is not limited.
+func (s *Stack) minHeartbeatInterval() time.Duration {
+	if s.heartbeatRate <= 0 {
+		return 0
+	}
+
+	return time.Second / time.Duration(s.heartbeatRate)
+}
+
+// coalescedStatus returns the status for the heartbeats, reusing the last one
+// when it was read within the minimum interval.
+func (s *Stack) coalescedStatus() Status {
+	min := s.minHeartbeatInterval()
+	if min == 0 {
+		return s.Status()
+	}
+
+	s.heartbeatMx.Lock()
+	defer s.heartbeatMx.Unlock()
+	if !s.heartbeatRead.IsZero() && time.Since(s.heartbeatRead) < min && !s.heartbeatStatus.Closed {
+		return s.heartbeatStatus
+	}
+
+	s.heartbeatStatus = s.Status()
+	s.heartbeatRead = time.Now()
+	return s.heartbeatStatus
+}
+
+// Heartbeat delivers a status snapshot of the queue on the returned channel
+// every time the interval passes. Calling the returned function stops the
+// heartbeat and closes the channel. It is safe to call it multiple times. When
+// the queue gets closed, the heartbeat delivers a final status and closes the
+// channel. When the MaxHeartbeatRate option is set, the interval is raised to
+// the minimum allowed by the rate, and the concurrent heartbeats may receive
+// the same, coalesced status. When the interval is not positive, and it was
+// not raised by MaxHeartbeatRate, Heartbeat returns a closed channel.
+func (s *Stack) Heartbeat(interval time.Duration) (<-chan Status, func()) {
+	if min := s.minHeartbeatInterval(); interval < min {
+		interval = min
+	}
+
+	c := make(chan Status)
+	if interval <= 0 {
+		close(c)
+		return c, func() {}
+	}
+
+	quit := make(chan struct{})
+	go func() {
+		defer close(c)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-quit:
+				return
+			}
+
+			status := s.coalescedStatus()
+			select {
+			case c <- status:
+			case <-quit:
+				return
+			}
+
+			if status.Closed {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return c, func() { once.Do(func() { close(quit) }) }
+}
+
+// ExportQueued returns the metadata of the currently queued jobs, passed in
+// with WaitMeta, ordered from the bottom of the stack to the top. The jobs
+// without metadata are represented by nil. When the stack is closed, it
+// returns nil.
+//
+// The stack doesn't persist the jobs. To restore the queued work in a new
+// stack, e.g. after a restart, resubmit the jobs in the exported order,
+// waiting for each to get queued before submitting the next, so that the
+// same LIFO order is preserved.
+func (s *Stack) ExportQueued() []interface{} {
+	var meta []interface{}
+	s.call(func() {
+		meta = make([]interface{}, s.stack.size())
+		i := len(meta)
+		s.stack.each(func(j *job) bool {
+			i--
+			meta[i] = j.meta
+			return true
+		})
+	})
+
+	return meta
+}
+
+// ActiveHolders returns the stack traces of the callers holding a slot,
+// captured when they acquired it, in the order of the acquisition. The
+// traces are captured only when the Debug option is set, otherwise it returns
+// nil. When the stack is closed, it returns nil.
+func (s *Stack) ActiveHolders() []string {
+	var traces []string
+	s.call(func() {
+		for _, j := range s.held {
+			traces = append(traces, formatTrace(j.trace))
+		}
+	})
+
+	return traces
+}
+
+// LoopStats returns the aggregate time spent by the control loop of the stack,
+// when the InstrumentLoop option is set. When the stack is closed, it returns
+// the last measured values.
+func (s *Stack) LoopStats() LoopStats {
+	var stats LoopStats
+	if !s.call(func() { stats = s.loopStats }) {
+		<-s.hasQuit
+		stats = s.loopStats
+	}
+
+	return stats
+}
+
+// QueueDepthHistogram returns how many times the stack was observed at each
+// depth, by the depth, when the TrackQueueDepth option is set. The depth is
+// observed every time a job is queued or taken from the stack. To bound the
+// memory, the depths over MaxStackSize or over 1024, whichever is lower, are
+// counted at the limit. When the stack is closed, it returns nil.
+func (s *Stack) QueueDepthHistogram() map[int]int {
+	var h map[int]int
+	s.call(func() {
+		h = make(map[int]int, len(s.stack.depths))
+		for d, c := range s.stack.depths {
+			h[d] = c
+		}
+	})
+
+	return h
+}
+
+// LastShed returns the time when the stack last dropped or timed out a job,
+// and whether it happened at all.
+func (s *Stack) LastShed() (time.Time, bool) {
+	var t time.Time
+	if !s.call(func() { t = s.lastShed }) {
+		<-s.hasQuit
+		t = s.lastShed
+	}
+
+	return t, !t.IsZero()
+}
+
+// TimeToFirstSchedule returns how long it took from the creation of the stack
+// until the first job was scheduled, e.g. for analyzing the cold start. It
+// returns false, if no job was scheduled yet. When the stack is closed, it
+// returns the last measured value.
+func (s *Stack) TimeToFirstSchedule() (time.Duration, bool) {
+	var first time.Time
+	if !s.call(func() { first = s.firstScheduled }) {
+		<-s.hasQuit
+		first = s.firstScheduled
+	}
+
+	if first.IsZero() {
+		return 0, false
+	}
+
+	return first.Sub(s.created), true
+}
+
+// LastActivity returns the time when the control loop of the stack last
+// finished handling an event, e.g. a submitted or a released job, or a status
+// request. It doesn't change while the stack is idle. It can be used as a
+// liveness probe of the control loop: when it is stale while there are jobs
+// waiting to be processed, the control loop may be stuck. It doesn't require
+// the control loop, so it can be called also when the loop is blocked.
+func (s *Stack) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActivity))
+}
+
+// WaitBelowDepth blocks until the number of the queued jobs is not higher than
+// the target, e.g. to pause a producer until the backlog drains. It returns
+// the error of the context, when the context is canceled before. A negative
+// target is treated as zero. If the stack gets closed before the target was
+// reached, it returns ErrClosed.
+func (s *Stack) WaitBelowDepth(ctx context.Context, target int) error {
+	if target < 0 {
+		target = 0
+	}
+
+	c := make(chan struct{})
+	if !s.call(func() {
+		if s.stack.size() <= target {
+			close(c)
+			return
+		}
+
+		if s.depthWait == nil {
+			s.depthWait = make(map[chan struct{}]int)
+		}
+
+		s.depthWait[c] = target
+	}) {
+		return s.err(ErrClosed)
+	}
+
 	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		s.call(func() { delete(s.depthWait, c) })
+		return ctx.Err()
 	case <-s.hasQuit:
-		return Status{Closed: true}
-	case s.status <- req:
-		return <-req
+		select {
+		case <-c:
+			return nil
+		default:
+			return s.err(ErrClosed)
+		}
+	}
+}
+
+// Efficiency returns how effectively the concurrency budget was used since the
+// previous call, or since the stack was created, as the time weighted average
+// of the running jobs divided by MaxConcurrency, in the range of [0, 1]. Each
+// call starts a new measurement window. When the stack is closed, it returns
+// zero.
+func (s *Stack) Efficiency() float64 {
+	var e float64
+	s.call(func() {
+		s.accountBusy()
+		if s.capacityTime > 0 {
+			e = s.busyTime / s.capacityTime
+		}
+
+		if e > 1 {
+			e = 1
+		}
+
+		s.busyTime = 0
+		s.capacityTime = 0
+	})
+
+	return e
+}
+
+// SustainedConcurrency returns the highest number of concurrently running jobs
+// during the most recent period without dropped or timed out jobs, that lasted
+// at least for the SustainedWindow. It can be used as a hint for setting
+// MaxConcurrency. It returns zero, if there was no such period yet. When the
+// stack is closed, it returns zero.
+func (s *Stack) SustainedConcurrency() int {
+	var c int
+	s.call(func() { c = s.sustained() })
+	return c
+}
+
+// DrainStats returns the counters accumulated since the previous call, or since
+// the stack was created, and resets them, in a single step, so that no events
+// are counted twice or missed between the calls. When the stack is closed, it
+// returns the zero Stats.
+func (s *Stack) DrainStats() Stats {
+	var stats Stats
+	s.call(func() {
+		stats = s.delta
+		s.delta = Stats{Since: s.now()}
+	})
+
+	return stats
+}
+
+// Shadow starts mirroring the submitted jobs to a shadow stack, created with
+// the candidate options, recording what the stack would have done with them,
+// e.g. before raising the limits in production. The outcome of the jobs in the
+// stack is not affected. The mirrored jobs don't execute anything, they hold
+// their slot in the shadow stack until the original job is done, or, when the
+// original job was rejected, until they get scheduled. The jobs attached with
+// WaitDedup are mirrored only once, and the jobs moved from another stack are
+// not mirrored. The callbacks of the candidate options are called for the
+// mirrored jobs.
+//
+// Calling Shadow again replaces the shadow stack, and resets the recorded
+// outcomes. The shadow stack is closed together with the stack. If the stack
+// was already closed, Shadow returns ErrClosed.
+func (s *Stack) Shadow(candidate Options) error {
+	sh := With(candidate)
+	if !s.call(func() {
+		s.closeShadow()
+		s.shadow = sh
+	}) {
+		sh.CloseForced()
+		return s.err(ErrClosed)
+	}
+
+	return nil
+}
+
+// ShadowStats returns the counters of the shadow stack started with Shadow,
+// telling how many of the mirrored jobs would have been scheduled, completed,
+// dropped or timed out under the candidate options. When no shadow was
+// started, or the stack is closed, it returns the zero Stats.
+func (s *Stack) ShadowStats() Stats {
+	var sh *Stack
+	s.call(func() { sh = s.shadow })
+	if sh == nil {
+		return Stats{}
+	}
+
+	var stats Stats
+	sh.call(func() { stats = sh.total })
+	return stats
+}
+
+// ForceSchedule schedules the first queued job, counting from the top of the
+// stack, whose metadata, passed in with WaitMeta, matches pred, immediately,
+// regardless of the MaxConcurrency, the order of the stack, or a pause, e.g.
+// as an administrative override. The forced job occupies a slot as usual, so
+// until the running jobs finish, the number of the active jobs can exceed
+// MaxConcurrency, and no other queued jobs are scheduled. It returns false,
+// if no queued job matched, or the stack was closed. The predicate is called
+// from the control loop of the stack, so it should return fast, and it must
+// not call the methods of the stack.
+func (s *Stack) ForceSchedule(pred func(meta interface{}) bool) bool {
+	var found bool
+	s.call(func() {
+		var match *job
+		s.stack.each(func(j *job) bool {
+			if pred(j.meta) {
+				match = j
+				return false
+			}
+
+			return true
+		})
+
+		if match != nil {
+			s.stack.remove(match)
+			s.schedule(match)
+			found = true
+		}
+	})
+
+	return found
+}
+
+// Pause stops scheduling the jobs, until Resume is called. The jobs already
+// being executed are not affected, and the new jobs are queued, or dropped
+// or timed out, according to the limits of the stack. Closing the stack
+// resumes the scheduling, so that the queued jobs can drain. If the stack was
+// already closed, or it is being closed, Pause returns ErrClosed.
+func (s *Stack) Pause() error {
+	var closing bool
+	if !s.call(func() {
+		closing = s.closing
+		if !closing {
+			s.paused = true
+		}
+	}) || closing {
+		return s.err(ErrClosed)
+	}
+
+	return nil
+}
+
+// Resume continues scheduling the jobs after Pause. If the stack was already
+// closed, Resume returns ErrClosed.
+func (s *Stack) Resume() error {
+	if !s.call(func() {
+		s.paused = false
+		s.fill()
+	}) {
+		return s.err(ErrClosed)
 	}
 
+	return nil
+}
+
+// BoostConcurrency raises the effective MaxConcurrency of the stack to n for
+// the duration d, after which the configured value is restored. The jobs
+// already running at that point are not affected. When the boosts overlap,
+// the higher concurrency and the later end of the window apply. If the stack
+// was already closed, BoostConcurrency returns ErrClosed.
+func (s *Stack) BoostConcurrency(n int, d time.Duration) error {
+	if !s.call(func() {
+		if n > s.boost {
+			s.boost = n
+		}
+
+		until := time.Now().Add(d)
+		if s.boostTimeout == nil || until.After(s.boostUntil) {
+			s.boostUntil = until
+			s.boostTimeout = time.After(d)
+		}
+
+		s.fill()
+	}) {
+		return s.err(ErrClosed)
+	}
+
+	return nil
+}
+
+// Failover registers a standby stack, that takes over the work when the
+// current stack is closed. When the current stack enters the teardown, by
+// any of the close methods, its queued jobs are moved to the standby,
+// preserving their order and their timeouts, like with Migrate, while the jobs
+// already running finish as normal. The moved jobs are placed below the jobs
+// already queued in the standby. The timeouts are enforced starting from the
+// bottom of the stack, so when the standby has a different Timeout option, a
+// moved job may time out only after the jobs queued below it.
+//
+// The jobs submitted after the current stack was closed receive a
+// *RedirectError, pointing to the standby. If the standby is already closed at
+// the time of the handoff, the queued jobs receive ErrClosedWhileQueued. The
+// standby stack needs to be closed separately. If the current stack was
+// already closed, Failover returns ErrClosed. A stack cannot be its own
+// standby, in which case Failover returns an error matching
+// ErrInvalidOptions.
+func (s *Stack) Failover(standby *Stack) error {
+	if standby == s {
+		return s.err(errFailoverSelf)
+	}
+
+	if !s.call(func() { s.standby = standby }) {
+		return s.err(ErrClosed)
+	}
+
+	return nil
+}
+
+// Migrate creates a new stack with the provided options, and moves the queued
+// jobs to it, preserving their order. The jobs that don't fit in the new stack
+// are dropped, and receive ErrStackFull. The current stack is closed the same
+// way as with Close: it doesn't accept new jobs anymore, and the jobs that are
+// already being executed can finish. The returned stack needs to be closed
+// once it's not used anymore. If the current stack was already closed, or it
+// is being closed, Migrate returns ErrClosed.
+func (s *Stack) Migrate(o Options) (*Stack, error) {
+	ns := With(o)
+	var closing bool
+	if !s.call(func() {
+		if s.closing {
+			closing = true
+			return
+		}
+
+		s.flushSequenced()
+		s.handOverTo(ns)
+		s.beginClose(closeGraceful)
+	}) || closing {
+		ns.Close()
+		return nil, s.err(ErrClosed)
+	}
+
+	return ns, nil
 }
 
+// Reconfigure changes the options of the stack. The jobs waiting in the stack
+// are scheduled or dropped according to the new limits. The jobs dropped this
+// way receive ErrEvictedByReconfigure.
+//
+// MaxConcurrency <= 0 always means the default concurrency level of 1, and it
+// never stops the scheduling of the jobs. To stop scheduling temporarily, use
+// Pause. When the stack was created in strict mode, Reconfigure returns an
+// error matching ErrInvalidOptions for MaxConcurrency <= 0.
 func (s *Stack) Reconfigure(o Options) error {
+	if s.strict && o.MaxConcurrency <= 0 {
+		return s.err(errPauseWithZero)
+	}
+
 	select {
 	case <-s.hasQuit:
-		return ErrClosed
+		return s.err(ErrClosed)
 	case s.reconfigure <- o:
 		return nil
 	}
 }
 
+// Options returns the current effective options of the stack. When the stack
+// is closed, it returns the last options.
+func (s *Stack) Options() Options {
+	var o Options
+	if !s.call(func() { o = s.options }) {
+		<-s.hasQuit
+		o = s.options
+	}
+
+	return o
+}
+
+// ReconfigureSync is like Reconfigure, but it returns only after the new
+// options were applied, so the subsequent calls observe the new limits. If the
+// stack was already closed, it returns ErrClosed.
+func (s *Stack) ReconfigureSync(o Options) error {
+	if s.strict && o.MaxConcurrency <= 0 {
+		return s.err(errPauseWithZero)
+	}
+
+	if !s.call(func() { s.applyOptions(o) }) {
+		return s.err(ErrClosed)
+	}
+
+	return nil
+}
+
 // Close frees up the resources used by a Stack instance.
 //
 // After called, the queue stops accepting new jobs, but it waits until all the
 // jobs are done, including those waiting in the queue.
 //
+// When the stack was paused, Close resumes scheduling the queued jobs.
+//
 // If the close timeout is set to >0, then forces closing after the timeout
 // has passed. If the timeout has passed, the queued jobs receive ErrClosed.
 // The close timeout can be set as an initialization option to the queue.
+//
+// Once Close was called, the jobs submitted after it always receive ErrClosed
+// immediately, also while the queued jobs are still draining, and also when
+// the submission coincides with the expiry of the close timeout.
 func (s *Stack) Close() {
 	select {
 	case <-s.hasQuit:
-	case s.quit <- false:
+	case s.quit <- closeGraceful:
+	}
+}
+
+// CloseWithin is like Close, but it forces closing after d has passed, even if
+// the close timeout was not set, or it was set to a longer duration. If the
+// duration has passed, the queued jobs receive ErrClosedWhileQueued.
+func (s *Stack) CloseWithin(d time.Duration) {
+	s.call(func() {
+		s.beginClose(closeGraceful)
+		s.closeWithin(d)
+	})
+}
+
+// CloseDrainRunning frees up the resources used by a Stack instance.
+//
+// When called, the stack stops accepting new jobs, and the queued jobs receive
+// ErrClosed immediately, but the jobs already being executed are allowed to
+// finish. CloseDrainRunning returns only after all the active jobs are done, or,
+// if set, the close timeout has passed.
+func (s *Stack) CloseDrainRunning() {
+	select {
+	case <-s.hasQuit:
+	case s.quit <- closeDrainRunning:
+		<-s.hasQuit
 	}
 }
 
+// Labels returns a copy of the static labels of the stack, set with the Labels
+// option.
+func (s *Stack) Labels() map[string]string {
+	return copyLabels(s.labels)
+}
+
+// Closed returns a channel that is closed when the stack has finished
+// closing, either gracefully, after the queued and active jobs are done, or
+// forced. It allows waiting for the teardown in a select statement, e.g.
+// together with a context.
+func (s *Stack) Closed() <-chan struct{} {
+	return s.hasQuit
+}
+
 // CloseForced frees up the resources used by a Stack instance.
 //
 // When called, the queued jobs receive ErrClosed.
 func (s *Stack) CloseForced() {
 	select {
 	case <-s.hasQuit:
-	case s.quit <- true:
+	case s.quit <- closeForced:
+	}
+}
+
+// CloseAll closes the stacks gracefully, the same way as Close, and waits until
+// all of them have finished closing. If the context is canceled before, it
+// closes the remaining ones with CloseForced, and returns the error of the
+// context.
+func CloseAll(ctx context.Context, stacks ...*Stack) error {
+	for _, s := range stacks {
+		s.Close()
 	}
+
+	for i, s := range stacks {
+		select {
+		case <-s.Closed():
+		case <-ctx.Done():
+			for _, s := range stacks[i:] {
+				s.CloseForced()
+				<-s.Closed()
+			}
+
+			return ctx.Err()
+		}
+	}
+
+	return nil
 }
@@ -1,11 +1,59 @@
 package jobqueue
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+type testClock struct {
+	mx  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) get() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type fakeQueue struct {
+	err    error
+	calls  int
+	closed bool
+}
+
+func (q *fakeQueue) Wait() (func(), error) {
+	q.calls++
+	return func() {}, q.err
+}
+
+func (q *fakeQueue) Do(job func()) error {
+	q.calls++
+	if q.err != nil {
+		return q.err
+	}
+
+	job()
+	return nil
+}
+
+func (q *fakeQueue) Status() Status { return Status{Closed: q.closed} }
+func (q *fakeQueue) Close()         { q.closed = true }
+
 type jobCounter struct {
 	mx                  sync.Mutex
 	activeJobs, maxJobs int
@@ -30,6 +78,48 @@ func (c *jobCounter) do(d time.Duration) {
 	time.Sleep(d)
 }
 
+type testReporter struct {
+	mx     sync.Mutex
+	events []string
+}
+
+func (r *testReporter) record(e string, meta interface{}) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.events = append(r.events, e+":"+meta.(string))
+}
+
+func (r *testReporter) JobScheduled(meta interface{})        { r.record("scheduled", meta) }
+func (r *testReporter) JobDone(meta interface{})             { r.record("done", meta) }
+func (r *testReporter) JobDropped(meta interface{}, _ error) { r.record("dropped", meta) }
+
+func (r *testReporter) getEvents() []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+type labeledReporter struct {
+	testReporter
+	labels map[string]string
+}
+
+func (r *labeledReporter) SetLabels(l map[string]string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.events != nil {
+		panic("labels set after notification")
+	}
+
+	r.labels = l
+}
+
+func (r *labeledReporter) getLabels() map[string]string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.labels
+}
+
 func TestSingleJob(t *testing.T) {
 	w := With(Options{MaxConcurrency: 1, MaxStackSize: 1})
 	defer w.CloseForced()
@@ -46,6 +136,22 @@ func TestDefaultConcurrency(t *testing.T) {
 	}
 }
 
+func TestNilJob(t *testing.T) {
+	w := New()
+	defer w.CloseForced()
+	if err := w.Do(nil); err != ErrNilJob {
+		t.Error("failed to fail with ErrNilJob", err)
+	}
+
+	if s := w.Status(); s.ActiveJobs != 0 {
+		t.Error("leaked slot")
+	}
+
+	if err := w.Do(func() {}); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestSetMaxConcurrency(t *testing.T) {
 	w := With(Options{MaxConcurrency: 3, MaxStackSize: 6})
 	defer w.CloseForced()
@@ -142,7 +248,7 @@ func TestCancel(t *testing.T) {
 				continue
 			}
 
-			if r == ErrTimeout {
+			if errors.Is(r, ErrTimeout) {
 				found = true
 				continue
 			}
@@ -156,171 +262,3525 @@ func TestCancel(t *testing.T) {
 	})
 }
 
-func TestTeardown(t *testing.T) {
-	t.Run("call after closed", func(t *testing.T) {
-		q := New()
-		q.Close()
-		<-q.hasQuit
-		_, err := q.Wait()
-		if err != ErrClosed {
-			t.Fail()
+func TestReleaseTimeout(t *testing.T) {
+	q := With(Options{ReleaseTimeout: 12 * time.Millisecond})
+	defer q.CloseForced()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block the control loop by not receiving the status response:
+	hold := make(chan Status)
+	q.status <- hold
+
+	released := make(chan struct{})
+	go func() {
+		done()
+		close(released)
+	}()
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("failed to give up the release")
+	}
+
+	<-hold
+	if s := q.Status(); s.AbandonedReleases != 1 || s.ActiveJobs != 1 {
+		t.Error("invalid status", s)
+	}
+}
+
+func TestBlockedWaiters(t *testing.T) {
+	q := New()
+	defer q.CloseForced()
+
+	// block the control loop by not receiving the status response:
+	hold := make(chan Status)
+	q.status <- hold
+
+	for i := 0; i < 3; i++ {
+		go q.Wait()
+	}
+
+	for atomic.LoadInt64(&q.blockedWaiters) != 3 {
+	}
+
+	<-hold
+	for q.Status().BlockedWaiters != 0 {
+	}
+
+	if s := q.Status(); s.ActiveJobs != 1 || s.QueuedJobs != 2 {
+		t.Error("failed to accept the waiters", s)
+	}
+}
+
+func TestRecencyCap(t *testing.T) {
+	q := With(Options{RecencyCap: 2})
+	defer q.CloseForced()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			if err := q.Do(func() { order <- i }); err != nil {
+				t.Error(err)
+			}
+		}(i)
+
+		for q.Status().QueuedJobs != i+1 {
 		}
-	})
+	}
 
-	t.Run("call after closed while busy", func(t *testing.T) {
+	done()
+	for _, expected := range []int{3, 2, 0, 1} {
+		if i := <-order; i != expected {
+			t.Errorf("invalid scheduling order, got: %d, expected: %d", i, expected)
+		}
+	}
+}
+
+func TestNamedErrors(t *testing.T) {
+	q := With(Options{Name: "test-stack", MaxStackSize: 1})
+	defer q.CloseForced()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer done()
+	dropped := make(chan error)
+	go func() {
+		_, err := q.Wait()
+		dropped <- err
+	}()
+
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	go q.Wait()
+	err = <-dropped
+	if !errors.Is(err, ErrStackFull) {
+		t.Fatal("failed to fail with ErrStackFull", err)
+	}
+
+	if !strings.Contains(err.Error(), "test-stack") {
+		t.Error("failed to include the name in the error", err)
+	}
+
+	var named *Error
+	if !errors.As(err, &named) || named.Name != "test-stack" {
+		t.Error("failed to return a named error", err)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	t.Run("scheduled immediately", func(t *testing.T) {
 		q := New()
-		done, err := q.Wait()
+		defer q.CloseForced()
+		scheduled, done, err := q.Submit()
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		defer done()
-		q.Close()
-		_, err = q.Wait()
-		if err != ErrClosed {
-			t.Error("failed to report closed")
+		if !scheduled {
+			t.Error("failed to report immediate scheduling")
 		}
 	})
 
-	t.Run("jobs get processed", func(t *testing.T) {
+	t.Run("queued", func(t *testing.T) {
 		q := New()
-		completeJobs := make(chan struct{})
-		for i := 0; i < 3; i++ {
-			go func() {
-				done, err := q.Wait()
-				if err != nil {
-					t.Error(err)
-					return
-				}
-
-				<-completeJobs
-				done()
-			}()
+		defer q.CloseForced()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		for {
-			s := q.Status()
-			if s.ActiveJobs+s.QueuedJobs == 3 {
-				break
+		result := make(chan bool)
+		go func() {
+			scheduled, done, err := q.Submit()
+			if err != nil {
+				t.Error(err)
+				return
 			}
+
+			done()
+			result <- scheduled
+		}()
+
+		for q.Status().QueuedJobs != 1 {
 		}
 
-		q.Close()
-		close(completeJobs)
-		<-q.hasQuit
+		done()
+		if <-result {
+			t.Error("failed to report queueing")
+		}
 	})
 
-	t.Run("teardown timeout", func(t *testing.T) {
-		q := With(Options{CloseTimeout: 12 * time.Millisecond})
-
-		_, err := q.Wait()
+	t.Run("dropped", func(t *testing.T) {
+		q := With(Options{Timeout: time.Millisecond})
+		defer q.CloseForced()
+		done, err := q.Wait()
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		var wg sync.WaitGroup
-		for i := 0; i < 2; i++ {
-			wg.Add(1)
-			go func() {
-				_, err := q.Wait()
-				if err != ErrClosed {
-					t.Error("failed to fail with ErrClosed")
-				}
+		defer done()
+		scheduled, _, err := q.Submit()
+		if !errors.Is(err, ErrTimeout) {
+			t.Error("failed to time out", err)
+		}
 
-				wg.Done()
-			}()
+		if scheduled {
+			t.Error("failed to report not scheduled")
 		}
+	})
+}
 
-		for {
-			s := q.Status()
-			if s.ActiveJobs+s.QueuedJobs == 3 {
-				break
+func TestWaitWithStatus(t *testing.T) {
+	q := With(Options{Admit: func(_ interface{}, s Status) bool { return s.QueuedJobs == 0 }})
+	defer q.Close()
+
+	done, status, err := q.WaitWithStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.ActiveJobs != 1 || status.QueuedJobs != 0 {
+		t.Fatal("invalid status of the scheduled job", status)
+	}
+
+	queued := make(chan Status)
+	go func() {
+		done, status, err := q.WaitWithStatus()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		done()
+		queued <- status
+	}()
+
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	_, status, err = q.WaitWithStatus()
+	if err != ErrAdmissionDenied {
+		t.Fatal("failed to reject the job", err)
+	}
+
+	if status.ActiveJobs != 1 || status.QueuedJobs != 1 {
+		t.Error("invalid status of the rejected job", status)
+	}
+
+	done()
+	if s := <-queued; s.ActiveJobs != 1 || s.QueuedJobs != 1 {
+		t.Error("invalid status of the queued job", s)
+	}
+
+	q.Close()
+	<-q.hasQuit
+	if _, status, err := q.WaitWithStatus(); err != ErrClosed || !status.Closed {
+		t.Error("failed to report closed", status, err)
+	}
+}
+
+func TestTimeoutWaited(t *testing.T) {
+	q := With(Options{Timeout: 30 * time.Millisecond})
+	defer q.Close()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer done()
+	_, err = q.Wait()
+	waited, ok := TimeoutWaited(err)
+	if !ok || !errors.Is(err, ErrTimeout) {
+		t.Fatal("failed to time out", err)
+	}
+
+	if waited < 30*time.Millisecond || waited > 90*time.Millisecond {
+		t.Error("invalid waited duration", waited)
+	}
+
+	if _, ok := TimeoutWaited(ErrStackFull); ok {
+		t.Error("unexpected timeout")
+	}
+
+	if waited, ok := TimeoutWaited(&Error{Name: "foo", Err: ErrTimeout}); !ok || waited != 0 {
+		t.Error("failed to report timeout without waiting", waited, ok)
+	}
+}
+
+func TestTimeoutGrace(t *testing.T) {
+	for _, test := range []struct {
+		title     string
+		grace     time.Duration
+		finishing bool
+		expected  error
+	}{
+		{"no grace", 0, true, ErrTimeout},
+		{"not finishing", 120 * time.Millisecond, false, ErrTimeout},
+		{"finishing", 120 * time.Millisecond, true, nil},
+	} {
+		t.Run(test.title, func(t *testing.T) {
+			q := With(Options{Timeout: 15 * time.Millisecond, TimeoutGrace: test.grace})
+			defer q.Close()
+
+			done, finishing, err := q.WaitFinishing()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.finishing {
+				finishing()
+			}
+
+			result := make(chan error)
+			go func() {
+				done, err := q.Wait()
+				done()
+				result <- err
+			}()
+
+			for q.Status().QueuedJobs != 1 {
+			}
+
+			time.Sleep(30 * time.Millisecond)
+			done()
+			if err := <-result; !errors.Is(err, test.expected) {
+				t.Error("unexpected result", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestWaitChan(t *testing.T) {
+	q := New()
+	defer q.Close()
+
+	grant, cancel := q.WaitChan()
+	defer cancel()
+	g := <-grant
+	if g.Err != nil {
+		t.Fatal(g.Err)
+	}
+
+	grant, cancel = q.WaitChan()
+	select {
+	case <-grant:
+		t.Fatal("unexpected grant")
+	case <-time.After(15 * time.Millisecond):
+		cancel()
+	}
+
+	for q.Status().QueuedJobs != 0 {
+	}
+
+	grant, cancel = q.WaitChan()
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	g.Done()
+	for q.Status().QueuedJobs != 0 {
+	}
+
+	cancel()
+	for q.Status().ActiveJobs != 0 {
+	}
+
+	if _, ok := <-grant; ok {
+		t.Error("failed to close the grant channel")
+	}
+}
+
+func TestForceSchedule(t *testing.T) {
+	q := New()
+	defer q.Close()
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled := make(chan string, 3)
+	release := make(chan struct{})
+	for i, meta := range []string{"a", "b", "c"} {
+		go func(meta string) {
+			done, err := q.WaitMeta(meta)
+			if err != nil {
+				t.Error(err)
+				return
 			}
+
+			scheduled <- meta
+			<-release
+			done()
+		}(meta)
+
+		for q.Status().QueuedJobs != i+1 {
 		}
+	}
+
+	if q.ForceSchedule(func(meta interface{}) bool { return meta == "x" }) {
+		t.Error("unexpected match")
+	}
+
+	if !q.ForceSchedule(func(meta interface{}) bool { return meta == "a" }) {
+		t.Fatal("failed to force schedule")
+	}
+
+	if meta := <-scheduled; meta != "a" {
+		t.Error("invalid forced job", meta)
+	}
+
+	if s := q.Status(); s.ActiveJobs != 2 || s.QueuedJobs != 2 {
+		t.Error("invalid status", s.ActiveJobs, s.QueuedJobs)
+	}
+
+	done()
+	release <- struct{}{}
+	if meta := <-scheduled; meta != "c" {
+		t.Error("invalid order after forcing", meta)
+	}
+
+	close(release)
+	q.Close()
+	<-q.Closed()
+	if q.ForceSchedule(func(interface{}) bool { return true }) {
+		t.Error("unexpected match after closed")
+	}
+}
+
+func TestTryDo(t *testing.T) {
+	q := New()
+	defer q.Close()
+
+	var executed bool
+	if err := q.TryDo(func() { executed = true }); err != nil || !executed {
+		t.Fatal("failed to execute", err, executed)
+	}
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.TryDo(func() { t.Error("unexpected execution") }); err != ErrStackFull {
+		t.Error("failed to drop", err)
+	}
+
+	if s := q.Status(); s.QueuedJobs != 0 {
+		t.Error("unexpected queueing", s.QueuedJobs)
+	}
+
+	done()
+	if err := q.TryDo(nil); err != ErrNilJob {
+		t.Error("failed to reject nil job", err)
+	}
+}
+
+func TestDoReport(t *testing.T) {
+	q := With(Options{MaxStackSize: 1})
+	defer q.Close()
+
+	if queued, err := q.DoReport(func() {}); err != nil || queued {
+		t.Fatal("failed to report immediate execution", queued, err)
+	}
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan bool)
+	go func() {
+		queued, err := q.DoReport(func() {})
+		if err != nil {
+			t.Error(err)
+		}
+
+		result <- queued
+	}()
+
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	done()
+	if !<-result {
+		t.Error("failed to report queueing")
+	}
+
+	if _, err := q.DoReport(nil); err != ErrNilJob {
+		t.Error("failed to reject nil job", err)
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	q := New()
+	defer q.CloseForced()
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := q.WaitContext(ctx)
+		canceled <- err
+	}()
+
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	scheduled := make(chan error)
+	go func() {
+		scheduled <- q.Do(func() {})
+	}()
+
+	for q.Status().QueuedJobs != 2 {
+	}
+
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Error("failed to cancel", err)
+	}
+
+	if s := q.Status(); s.QueuedJobs != 1 {
+		t.Error("failed to remove the canceled job", s.QueuedJobs)
+	}
+
+	done()
+	if err := <-scheduled; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFailFastOnTimeout(t *testing.T) {
+	const timeout = 90 * time.Millisecond
+	q := With(Options{Timeout: timeout, FailFastOnTimeout: true})
+	defer q.CloseForced()
+
+	for i := 0; i < 3; i++ {
+		if err := q.Do(func() { time.Sleep(9 * time.Millisecond) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer done()
+	for i := 0; i < 30; i++ {
+		start := time.Now()
+		result := make(chan error, 1)
+		go func() {
+			_, err := q.Wait()
+			result <- err
+		}()
+
+		for {
+			select {
+			case err := <-result:
+				if !errors.Is(err, ErrTimeout) {
+					t.Fatal("unexpected error", err)
+				}
+
+				if time.Since(start) > timeout/2 {
+					t.Fatal("failed to fail fast")
+				}
+
+				if i < 5 {
+					t.Fatal("failed too early", i)
+				}
+
+				return
+			default:
+			}
+
+			if q.Status().QueuedJobs == i+1 {
+				break
+			}
+		}
+	}
+
+	t.Error("failed to fail fast")
+}
+
+func TestReporterMeta(t *testing.T) {
+	r := &testReporter{}
+	q := With(Options{MaxStackSize: 1, Reporter: r})
+	defer q.CloseForced()
+
+	done, err := q.WaitMeta("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := make(chan error)
+	go func() {
+		_, err := q.WaitMeta("b")
+		dropped <- err
+	}()
+
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	scheduled := make(chan func())
+	go func() {
+		done, err := q.WaitMeta("c")
+		if err != nil {
+			t.Error(err)
+		}
+
+		scheduled <- done
+	}()
+
+	if err := <-dropped; err != ErrStackFull {
+		t.Fatal("failed to drop", err)
+	}
+
+	done()
+	(<-scheduled)()
+	for q.Status().ActiveJobs != 0 {
+	}
+
+	expected := []string{"scheduled:a", "dropped:b", "done:a", "scheduled:c", "done:c"}
+	events := r.getEvents()
+	if len(events) != len(expected) {
+		t.Fatal("unexpected events", events)
+	}
+
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Error("unexpected events", events)
+			break
+		}
+	}
+}
+
+func TestReporterLabels(t *testing.T) {
+	labels := map[string]string{"service": "foo", "region": "bar"}
+	r := &labeledReporter{}
+	q := With(Options{Reporter: r, Labels: labels})
+	defer q.Close()
+
+	labels["service"] = "baz"
+	done, err := q.WaitMeta("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done()
+
+	expected := map[string]string{"service": "foo", "region": "bar"}
+	if l := r.getLabels(); !reflect.DeepEqual(l, expected) {
+		t.Error("invalid reporter labels", l)
+	}
+
+	if l := q.Labels(); !reflect.DeepEqual(l, expected) {
+		t.Error("invalid stack labels", l)
+	}
+
+	r2 := &labeledReporter{}
+	if err := q.ReconfigureSync(Options{Reporter: r2, Labels: map[string]string{"service": "qux"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := r2.getLabels(); !reflect.DeepEqual(l, expected) {
+		t.Error("invalid labels after reconfigure", l)
+	}
+}
+
+func TestShortestJobFirst(t *testing.T) {
+	q := With(Options{ShortestJobFirst: true})
+	defer q.CloseForced()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan time.Duration, 4)
+	for i, d := range []time.Duration{0, 3 * time.Millisecond, time.Millisecond, 2 * time.Millisecond} {
+		go func(d time.Duration) {
+			done, err := q.WaitEstimate(d)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			order <- d
+			done()
+		}(d)
+
+		for q.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	done()
+	for _, expected := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 0} {
+		if d := <-order; d != expected {
+			t.Errorf("invalid scheduling order, got: %v, expected: %v", d, expected)
+		}
+	}
+}
+
+func TestGo(t *testing.T) {
+	t.Run("execute", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		executed := make(chan struct{})
+		q.Go(func(context.Context) { close(executed) })
+		<-executed
+	})
+
+	t.Run("cancel running", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		canceled := make(chan struct{})
+		h := q.Go(func(ctx context.Context) {
+			<-ctx.Done()
+			close(canceled)
+		})
+
+		for q.Status().ActiveJobs != 1 {
+		}
+
+		q.CancelJob(h)
+		<-canceled
+		for q.Status().ActiveJobs != 0 {
+		}
+	})
+
+	t.Run("cancel queued", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		h := q.Go(func(context.Context) { t.Error("unexpected execution") })
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		q.CancelJob(h)
+		for q.Status().QueuedJobs != 0 {
+		}
+	})
+
+	t.Run("wait time", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waited := make(chan time.Duration)
+		q.Go(func(ctx context.Context) {
+			d, ok := WaitTimeFromContext(ctx)
+			if !ok {
+				t.Error("failed to receive the wait time")
+			}
+
+			waited <- d
+		})
+
+		time.Sleep(12 * time.Millisecond)
+		done()
+		if d := <-waited; d < 12*time.Millisecond || d > 120*time.Millisecond {
+			t.Error("unexpected wait time", d)
+		}
+	})
+
+	t.Run("queue name", func(t *testing.T) {
+		q := With(Options{Name: "foo"})
+		defer q.Close()
+		name := make(chan string)
+		q.Go(func(ctx context.Context) {
+			n, ok := QueueNameFromContext(ctx)
+			if !ok {
+				t.Error("failed to receive the queue name")
+			}
+
+			name <- n
+		})
+
+		if n := <-name; n != "foo" {
+			t.Error("invalid queue name", n)
+		}
+
+		if _, ok := QueueNameFromContext(context.Background()); ok {
+			t.Error("unexpected queue name")
+		}
+	})
+
+	t.Run("nil job", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		q.CancelJob(q.Go(nil))
+		if err := q.Do(func() {}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("panic handler", func(t *testing.T) {
+		recovered := make(chan interface{}, 1)
+		q := With(Options{PanicHandler: func(r interface{}) { recovered <- r }})
+		defer q.Close()
+
+		q.Go(func(context.Context) { panic("foo") })
+		if r := <-recovered; r != "foo" {
+			t.Fatal("invalid recovered value", r)
+		}
+
+		executed := make(chan struct{})
+		q.Go(func(context.Context) { close(executed) })
+		<-executed
+	})
+}
+
+func TestGoCallback(t *testing.T) {
+	t.Run("executed", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		var executed bool
+		result := make(chan error)
+		q.GoCallback(func() { executed = true }, func(err error) { result <- err })
+		if err := <-result; err != nil || !executed {
+			t.Error("failed to execute", err, executed)
+		}
+	})
+
+	t.Run("dropped", func(t *testing.T) {
+		q := With(Options{MaxStackSize: 1, ScheduleOrder: ScheduleFIFO, EvictOrder: EvictNewest})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		go func() {
+			done, err := q.Wait()
+			if err == nil {
+				done()
+			}
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		result := make(chan error)
+		q.GoCallback(func() { t.Error("unexpected execution") }, func(err error) { result <- err })
+		if err := <-result; err != ErrStackFull {
+			t.Error("failed to drop", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		q := With(Options{Timeout: 3 * time.Millisecond})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		result := make(chan error)
+		q.GoCallback(func() { t.Error("unexpected execution") }, func(err error) { result <- err })
+		if err := <-result; !errors.Is(err, ErrTimeout) {
+			t.Error("failed to time out", err)
+		}
+	})
+
+	t.Run("nil job", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		var result error
+		q.GoCallback(nil, func(err error) { result = err })
+		if result != ErrNilJob {
+			t.Error("failed to reject nil job", result)
+		}
+
+		q.GoCallback(nil, nil)
+	})
+}
+
+func TestProcessAll(t *testing.T) {
+	q := With(Options{MaxStackSize: 1, Timeout: 30 * time.Millisecond})
+	defer q.Close()
+
+	jobs := make(chan func())
+	go func() {
+		for i := 0; i < 12; i++ {
+			jobs <- func() { time.Sleep(9 * time.Millisecond) }
+		}
+
+		close(jobs)
+	}()
+
+	processed, dropped, timedOut := q.ProcessAll(jobs)
+	if processed+dropped+timedOut != 12 {
+		t.Error("failed to account for all the jobs", processed, dropped, timedOut)
+	}
+
+	if processed == 0 || dropped == 0 {
+		t.Error("unexpected counts", processed, dropped, timedOut)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	q := With(Options{
+		MaxStackSize: 1,
+		Breaker: Breaker{
+			Threshold: 2,
+			Window:    time.Second,
+			Cooldown:  30 * time.Millisecond,
+		},
+	})
+
+	defer q.Close()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			results <- q.Do(func() {})
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != ErrStackFull {
+			t.Fatal("failed to drop", err)
+		}
+	}
+
+	if s := q.Status(); s.Breaker != BreakerOpen {
+		t.Fatal("failed to open the breaker", s.Breaker)
+	}
+
+	if _, err := q.Wait(); err != ErrCircuitOpen {
+		t.Fatal("failed to reject with open circuit", err)
+	}
+
+	done()
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	done, err = q.Wait()
+	if err != nil {
+		t.Fatal("failed to accept the probe", err)
+	}
+
+	done()
+	if s := q.Status(); s.Breaker != BreakerClosed {
+		t.Error("failed to close the breaker", s.Breaker)
+	}
+
+	t.Run("canceled probe", func(t *testing.T) {
+		q := With(Options{Breaker: Breaker{Threshold: 1, Cooldown: 30 * time.Millisecond}})
+		defer q.Close()
+
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q.call(func() { q.openBreaker(time.Now()) })
+		time.Sleep(30 * time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		probe := make(chan error)
+		go func() {
+			_, err := q.WaitContext(ctx)
+			probe <- err
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		cancel()
+		if err := <-probe; err != context.Canceled {
+			t.Fatal("failed to cancel the probe", err)
+		}
+
+		done()
+		done, err = q.Wait()
+		if err != nil {
+			t.Fatal("failed to accept a new probe", err)
+		}
+
+		done()
+		if s := q.Status(); s.Breaker != BreakerClosed {
+			t.Error("failed to close the breaker", s.Breaker)
+		}
+	})
+}
+
+func TestWaitUnlessBacklog(t *testing.T) {
+	q := With(Options{MaxConcurrency: 1})
+	defer q.Close()
+
+	done, err := q.WaitUnlessBacklog(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done, err := q.WaitUnlessBacklog(2)
+			if err == nil {
+				done()
+			}
+
+			results <- err
+		}()
+	}
+
+	for q.Status().QueuedJobs != 2 {
+	}
+
+	if _, err := q.WaitUnlessBacklog(2); err != ErrBacklogTooDeep {
+		t.Fatal("failed to reject at deep backlog", err)
+	}
+
+	if s := q.Status(); s.QueuedJobs != 2 {
+		t.Fatal("invalid backlog", s.QueuedJobs)
+	}
+
+	done()
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWaitFair(t *testing.T) {
+	q := New()
+	defer q.CloseForced()
+
+	done, err := q.WaitFair("hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cold := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			done, err := q.WaitFair(fmt.Sprintf("cold-%d", i))
+			if err == nil {
+				done()
+			}
+
+			cold <- err
+		}(i)
+
+		for q.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				done, err := q.WaitFair("hot")
+				if err != nil {
+					return
+				}
+
+				done()
+			}
+		}()
+
+		for q.Status().QueuedJobs != i+4 {
+		}
+	}
+
+	done()
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-cold:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("cold submitter starved")
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	t.Run("round-robin", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+
+		done, err := q.WaitFair("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		order := make(chan string, 7)
+		for i, id := range []string{"c", "a", "b", "a", "b", "a", "b"} {
+			go func(id string) {
+				done, err := q.WaitFair(id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				order <- id
+				done()
+			}(id)
+
+			for q.Status().QueuedJobs != i+1 {
+			}
+		}
+
+		done()
+		var observed []string
+		for range []string{"c", "a", "b", "a", "b", "a", "b"} {
+			observed = append(observed, <-order)
+		}
+
+		if !reflect.DeepEqual(observed, []string{"b", "c", "a", "b", "a", "b", "a"}) {
+			t.Error("failed to take turns", observed)
+		}
+	})
+}
+
+func TestWaitDedup(t *testing.T) {
+	q := With(Options{ScheduleOrder: ScheduleFIFO})
+	defer q.Close()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled := make(chan func(), 4)
+	submit := func(key string) {
+		done, err := q.WaitDedup(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		scheduled <- done
+	}
+
+	for i := 0; i < 3; i++ {
+		go submit("foo")
+	}
+
+	for {
+		var followers int
+		q.call(func() {
+			if j, ok := q.dedup["foo"]; ok {
+				followers = len(j.followers)
+			}
+		})
+
+		if followers == 2 {
+			break
+		}
+	}
+
+	go submit("bar")
+	for q.Status().QueuedJobs != 2 {
+	}
+
+	done()
+	var dones []func()
+	for len(dones) < 3 {
+		dones = append(dones, <-scheduled)
+	}
+
+	if s := q.Status(); s.ActiveJobs != 1 || s.QueuedJobs != 1 {
+		t.Fatal("failed to use a single slot", s)
+	}
+
+	for i, done := range dones {
+		done()
+		done()
+		if i < len(dones)-1 && q.Status().ActiveJobs != 1 {
+			t.Fatal("released the slot too early")
+		}
+	}
+
+	done = <-scheduled
+	if s := q.Status(); s.ActiveJobs != 1 || s.QueuedJobs != 0 {
+		t.Error("failed to schedule the other key", s)
+	}
+
+	done()
+}
+
+func TestLoopStats(t *testing.T) {
+	q := With(Options{InstrumentLoop: true})
+	defer q.Close()
+
+	for i := 0; i < 3; i++ {
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done()
+	}
+
+	q.Status()
+	stats := q.LoopStats()
+	if stats.Blocked <= 0 || stats.Submit <= 0 || stats.Done <= 0 || stats.Status <= 0 {
+		t.Error("failed to measure the control loop", stats)
+	}
+
+	q = New()
+	defer q.Close()
+	if stats := q.LoopStats(); stats != (LoopStats{}) {
+		t.Error("unexpected measurement", stats)
+	}
+}
+
+func TestDoDeadline(t *testing.T) {
+	t.Run("completes", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		errJob := errors.New("job")
+		if err := q.DoDeadline(time.Second, func() error { return errJob }); err != errJob {
+			t.Error("failed to return the error of the job", err)
+		}
+	})
+
+	t.Run("queue wait exceeded", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		var executed bool
+		err = q.DoDeadline(12*time.Millisecond, func() error {
+			executed = true
+			return nil
+		})
+
+		if !errors.Is(err, ErrTimeout) || executed {
+			t.Error("failed to time out", err, executed)
+		}
+
+		if waited, ok := TimeoutWaited(err); !ok || waited < 12*time.Millisecond {
+			t.Error("failed to report the time waited", waited, ok)
+		}
+
+		if s := q.Status(); s.QueuedJobs != 0 {
+			t.Error("failed to remove the job", s.QueuedJobs)
+		}
+	})
+
+	t.Run("execution exceeded", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		err := q.DoDeadlineContext(12*time.Millisecond, func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		})
+
+		if err != ErrDeadlineExceeded {
+			t.Error("failed to exceed the deadline", err)
+		}
+
+		if s := q.Status(); s.ActiveJobs != 0 {
+			t.Error("failed to release the slot", s.ActiveJobs)
+		}
+	})
+}
+
+func TestDoPhased(t *testing.T) {
+	t.Run("completes", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		errJob := errors.New("job")
+		if err := q.DoPhased(time.Second, 0, func(context.Context) error { return errJob }); err != errJob {
+			t.Error("failed to return the error of the job", err)
+		}
+	})
+
+	t.Run("queue wait exceeded", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		var executed bool
+		err = q.DoPhased(12*time.Millisecond, time.Second, func(context.Context) error {
+			executed = true
+			return nil
+		})
+
+		if waited, ok := TimeoutWaited(err); !ok || waited < 12*time.Millisecond || executed {
+			t.Error("failed to time out", err, executed)
+		}
+	})
+
+	t.Run("execution exceeded", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		err := q.DoPhased(time.Second, 12*time.Millisecond, func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		})
+
+		if err != ErrExecutionTimeout {
+			t.Error("failed to exceed the execution budget", err)
+		}
+
+		if s := q.Status(); s.ActiveJobs != 0 {
+			t.Error("failed to release the slot", s.ActiveJobs)
+		}
+	})
+}
+
+func TestScheduleFIFOEvictNewest(t *testing.T) {
+	q := With(Options{
+		MaxStackSize:  2,
+		ScheduleOrder: ScheduleFIFO,
+		EvictOrder:    EvictNewest,
+	})
+
+	defer q.Close()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			done, err := q.Wait()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			order <- i
+			done()
+		}(i)
+
+		for q.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	if _, err := q.Wait(); err != ErrStackFull {
+		t.Error("failed to drop the newest job", err)
+	}
+
+	done()
+	for i := 0; i < 2; i++ {
+		if o := <-order; o != i {
+			t.Error("invalid order", o, i)
+		}
+	}
+}
+
+func TestDoOrRetryAfter(t *testing.T) {
+	q := With(Options{MaxStackSize: 1})
+	defer q.Close()
+
+	if _, err := q.DoOrRetryAfter(func() { time.Sleep(12 * time.Millisecond) }); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		retryAfter time.Duration
+		err        error
+	}
+
+	results := make(chan result)
+	go func() {
+		retryAfter, err := q.DoOrRetryAfter(func() {})
+		results <- result{retryAfter, err}
+	}()
+
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	if d := q.EstimatedWait(); d < 12*time.Millisecond {
+		t.Error("invalid estimated wait", d)
+	}
+
+	go func() {
+		done, err := q.Wait()
+		if err == nil {
+			done()
+		}
+	}()
+
+	if r := <-results; r.err != ErrStackFull || r.retryAfter <= 0 {
+		t.Error("failed to return retry hint", r.retryAfter, r.err)
+	}
+
+	done()
+}
+
+func TestDoIfPrompt(t *testing.T) {
+	t.Run("runs within grace", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		var executed bool
+		ran, err := q.DoIfPrompt(time.Second, func() { executed = true })
+		if !ran || err != nil || !executed {
+			t.Error("failed to run the job", ran, err, executed)
+		}
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		var executed bool
+		ran, err := q.DoIfPrompt(12*time.Millisecond, func() { executed = true })
+		if ran || err != nil || executed {
+			t.Error("failed to skip the job", ran, err, executed)
+		}
+
+		if s := q.Status(); s.QueuedJobs != 0 {
+			t.Error("failed to remove the job", s.QueuedJobs)
+		}
+	})
+}
+
+func TestReserve(t *testing.T) {
+	q := With(Options{MaxConcurrency: 3})
+	defer q.Close()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Reserve(3); err != ErrStackFull {
+		t.Fatal("failed to reject the reservation", err)
+	}
+
+	for _, n := range []int{0, -1} {
+		if _, err := q.Reserve(n); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatal("failed to reject the invalid reservation", n, err)
+		}
+	}
+
+	r, err := q.Reserve(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := q.Status(); s.ActiveJobs != 3 {
+		t.Fatal("failed to reserve the slots", s.ActiveJobs)
+	}
+
+	scheduled := make(chan struct{})
+	go func() {
+		done, err := q.Wait()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		close(scheduled)
+		done()
+	}()
+
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	var executed bool
+	if !r.Run(func() { executed = true }) || !executed {
+		t.Fatal("failed to run the job")
+	}
+
+	<-scheduled
+	r.Release()
+	done()
+	for q.Status().ActiveJobs != 0 {
+	}
+
+	if r.Run(func() {}) {
+		t.Error("failed to disallow running after release")
+	}
+
+	q.Close()
+	if _, err := q.Reserve(1); err != ErrClosed {
+		t.Error("failed to fail after closed", err)
+	}
+
+	t.Run("panicking job", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		r, err := q.Reserve(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		func() {
+			defer func() { recover() }()
+			r.Run(func() { panic("test") })
+		}()
+
+		if s := q.Status(); s.ActiveJobs != 0 {
+			t.Error("failed to free the slot", s.ActiveJobs)
+		}
+	})
+}
+
+func TestLastShed(t *testing.T) {
+	q := With(Options{MaxStackSize: 1})
+	defer q.Close()
+
+	if _, ok := q.LastShed(); ok {
+		t.Fatal("unexpected shed")
+	}
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go q.Wait()
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	before := time.Now()
+	go func() {
+		done, err := q.Wait()
+		if err == nil {
+			done()
+		}
+	}()
+
+	for {
+		if _, ok := q.LastShed(); ok {
+			break
+		}
+	}
+
+	if last, _ := q.LastShed(); last.Before(before) || time.Since(last) > time.Second {
+		t.Error("invalid shed time", last)
+	}
+
+	done()
+}
+
+func TestAdmit(t *testing.T) {
+	var admitted []interface{}
+	q := With(Options{Admit: func(meta interface{}, s Status) bool {
+		if s.QueuedJobs >= 2 {
+			return false
+		}
+
+		admitted = append(admitted, meta)
+		return true
+	}})
+
+	defer q.CloseForced()
+
+	if _, err := q.WaitMeta("running"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		go q.WaitMeta(i)
+		for q.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	if _, err := q.WaitMeta(2); err != ErrAdmissionDenied {
+		t.Error("failed to deny admission", err)
+	}
+
+	if s := q.Status(); s.QueuedJobs != 2 {
+		t.Error("invalid queue", s.QueuedJobs)
+	}
+
+	var a []interface{}
+	q.call(func() { a = admitted })
+	if !reflect.DeepEqual(a, []interface{}{0, 1}) {
+		t.Error("invalid admission", a)
+	}
+}
+
+func TestBoostConcurrency(t *testing.T) {
+	t.Run("boost and revert", func(t *testing.T) {
+		q := New()
+		defer q.CloseForced()
+
+		done1, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := q.BoostConcurrency(2, 30*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		done2, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(40 * time.Millisecond)
+		go q.Wait()
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		done1()
+		if s := q.Status(); s.ActiveJobs != 1 || s.QueuedJobs != 1 {
+			t.Error("failed to revert", s)
+		}
+
+		done2()
+		if s := q.Status(); s.ActiveJobs != 1 || s.QueuedJobs != 0 {
+			t.Error("failed to schedule after revert", s)
+		}
+	})
+
+	t.Run("overlapping", func(t *testing.T) {
+		q := New()
+		defer q.CloseForced()
+
+		if err := q.BoostConcurrency(2, 30*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := q.BoostConcurrency(3, time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			if _, err := q.Wait(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		q.CloseForced()
+		if err := q.BoostConcurrency(2, time.Second); err != ErrClosed {
+			t.Error("failed to fail after closed", err)
+		}
+	})
+}
+
+func TestMaxQueuedBytes(t *testing.T) {
+	q := With(Options{
+		MaxQueuedBytes: 10,
+		SizeOf:         func(meta interface{}) int { return len(meta.(string)) },
+	})
+
+	defer q.CloseForced()
+
+	if _, err := q.WaitMeta(""); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, 3)
+	for i, meta := range []string{"foo", "barbaz"} {
+		go func(meta string) {
+			_, err := q.WaitMeta(meta)
+			results <- err
+		}(meta)
+
+		for q.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	if s := q.Status(); s.QueuedBytes != 9 {
+		t.Fatal("invalid queued bytes", s.QueuedBytes)
+	}
+
+	go func() {
+		_, err := q.WaitMeta("qux")
+		results <- err
+	}()
+
+	if err := <-results; err != ErrStackFull {
+		t.Fatal("failed to shed by size", err)
+	}
+
+	if s := q.Status(); s.QueuedJobs != 2 || s.QueuedBytes != 9 {
+		t.Fatal("invalid queue", s.QueuedJobs, s.QueuedBytes)
+	}
+
+	if _, err := q.WaitMeta("foobarbazqux"); err != ErrStackFull {
+		t.Fatal("failed to reject the oversize job", err)
+	}
+
+	if s := q.Status(); s.QueuedJobs != 2 || s.QueuedBytes != 9 {
+		t.Error("failed to keep the queued jobs", s.QueuedJobs, s.QueuedBytes)
+	}
+}
+
+func TestSlowJobs(t *testing.T) {
+	slow := make(chan time.Duration, 1)
+	q := With(Options{
+		SlowThreshold: 12 * time.Millisecond,
+		OnSlowJob:     func(d time.Duration) { slow <- d },
+	})
+
+	defer q.Close()
+
+	q.Do(func() {})
+	q.Do(func() { time.Sleep(15 * time.Millisecond) })
+	if d := <-slow; d < 12*time.Millisecond {
+		t.Error("invalid duration", d)
+	}
+
+	if s := q.Status(); s.SlowJobs != 1 {
+		t.Error("failed to count the slow jobs", s.SlowJobs)
+	}
+}
+
+func TestOnScheduleOnDone(t *testing.T) {
+	var (
+		events []string
+		held   time.Duration
+	)
+
+	q := With(Options{
+		OnSchedule: func(meta interface{}) {
+			events = append(events, fmt.Sprint("schedule ", meta))
+		},
+		OnDone: func(meta interface{}, heldFor time.Duration) {
+			events = append(events, fmt.Sprint("done ", meta))
+			held = heldFor
+		},
+	})
+
+	defer q.Close()
+
+	done, err := q.WaitMeta("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(12 * time.Millisecond)
+	done()
+
+	q.call(func() {
+		if !reflect.DeepEqual(events, []string{"schedule foo", "done foo"}) {
+			t.Error("invalid events", events)
+		}
+
+		if held < 12*time.Millisecond || held > time.Second {
+			t.Error("invalid duration", held)
+		}
+	})
+}
+
+func TestTimeToFirstSchedule(t *testing.T) {
+	c := &testClock{now: time.Now()}
+	q := withClock(Options{}, c.get)
+	if _, ok := q.TimeToFirstSchedule(); ok {
+		t.Error("unexpected first schedule")
+	}
+
+	c.advance(12 * time.Millisecond)
+	if err := q.Do(func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.advance(12 * time.Millisecond)
+	if err := q.Do(func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, ok := q.TimeToFirstSchedule(); !ok || d != 12*time.Millisecond {
+		t.Error("invalid time to first schedule", d, ok)
+	}
+
+	q.Close()
+	if d, ok := q.TimeToFirstSchedule(); !ok || d != 12*time.Millisecond {
+		t.Error("invalid time to first schedule after closed", d, ok)
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	q := New()
+	defer q.Close()
+
+	created := q.LastActivity()
+	if created.IsZero() {
+		t.Error("failed to initialize the activity")
+	}
+
+	time.Sleep(time.Millisecond)
+	if err := q.Do(func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	for !q.LastActivity().After(created) {
+	}
+
+	time.Sleep(3 * time.Millisecond)
+	active := q.LastActivity()
+	time.Sleep(3 * time.Millisecond)
+	if !q.LastActivity().Equal(active) {
+		t.Error("activity changed while idle")
+	}
+}
+
+func TestWaitBelowDepth(t *testing.T) {
+	q := New()
+	defer q.Close()
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	for i := 1; i <= 3; i++ {
+		go func() {
+			done, err := q.Wait()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			<-release
+			done()
+		}()
+
+		for q.Status().QueuedJobs != i {
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Millisecond)
+	defer cancel()
+	if err := q.WaitBelowDepth(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("failed to time out", err)
+	}
+
+	unblocked := make(chan error)
+	go func() { unblocked <- q.WaitBelowDepth(context.Background(), 1) }()
+	done()
+	select {
+	case <-unblocked:
+		t.Fatal("unblocked before the target depth")
+	case <-time.After(3 * time.Millisecond):
+	}
+
+	release <- struct{}{}
+	if err := <-unblocked; err != nil {
+		t.Error(err)
+	}
+
+	if s := q.Status(); s.QueuedJobs != 1 {
+		t.Error("unexpected queue depth", s.QueuedJobs)
+	}
+
+	close(release)
+	if err := q.WaitBelowDepth(context.Background(), 0); err != nil {
+		t.Error(err)
+	}
+
+	q.Close()
+	<-q.Closed()
+	if err := q.WaitBelowDepth(context.Background(), 0); err != ErrClosed {
+		t.Error("failed to fail after closed", err)
+	}
+}
+
+func TestEfficiency(t *testing.T) {
+	c := &testClock{now: time.Now()}
+	q := withClock(Options{MaxConcurrency: 2}, c.get)
+	defer q.Close()
+
+	c.advance(10 * time.Millisecond)
+	done1, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.advance(10 * time.Millisecond)
+	done2, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.advance(10 * time.Millisecond)
+	done1()
+	done2()
+	q.Status()
+	c.advance(10 * time.Millisecond)
+	if e := q.Efficiency(); e != 0.375 {
+		t.Error("invalid efficiency", e)
+	}
+
+	c.advance(10 * time.Millisecond)
+	if e := q.Efficiency(); e != 0 {
+		t.Error("failed to start a new window", e)
+	}
+}
+
+func TestSustainedConcurrency(t *testing.T) {
+	t.Run("shed-free period", func(t *testing.T) {
+		c := &testClock{now: time.Now()}
+		q := withClock(Options{MaxConcurrency: 3, MaxStackSize: 1, SustainedWindow: 10 * time.Second}, c.get)
+		defer q.CloseForced()
+
+		if _, err := q.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := q.SustainedConcurrency(); n != 0 {
+			t.Fatal("unexpected sustained concurrency", n)
+		}
+
+		c.advance(11 * time.Second)
+		if n := q.SustainedConcurrency(); n != 1 {
+			t.Fatal("invalid sustained concurrency", n)
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := q.Wait(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := q.SustainedConcurrency(); n != 3 {
+			t.Fatal("invalid sustained concurrency", n)
+		}
+
+		go q.Wait()
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		go q.Wait()
+		for {
+			if _, ok := q.LastShed(); ok {
+				break
+			}
+		}
+
+		if n := q.SustainedConcurrency(); n != 3 {
+			t.Error("failed to keep the sustained concurrency after shedding", n)
+		}
+	})
+
+	t.Run("shedding within the window", func(t *testing.T) {
+		c := &testClock{now: time.Now()}
+		q := withClock(Options{MaxStackSize: 1, SustainedWindow: 10 * time.Second}, c.get)
+		defer q.CloseForced()
+
+		if _, err := q.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		go q.Wait()
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		c.advance(5 * time.Second)
+		go q.Wait()
+		for {
+			if _, ok := q.LastShed(); ok {
+				break
+			}
+		}
+
+		c.advance(5 * time.Second)
+		if n := q.SustainedConcurrency(); n != 0 {
+			t.Error("unexpected sustained concurrency", n)
+		}
+	})
+}
+
+func TestSizedConstructors(t *testing.T) {
+	procs := runtime.GOMAXPROCS(0)
+	for _, test := range []struct {
+		title    string
+		stack    *Stack
+		expected int
+	}{
+		{"cpu bound", NewCPUBound(), procs},
+		{"io bound", NewIOBound(4), 4 * procs},
+		{"io bound, invalid multiplier", NewIOBound(0), procs},
+	} {
+		t.Run(test.title, func(t *testing.T) {
+			defer test.stack.Close()
+			if c := test.stack.Options().MaxConcurrency; c != test.expected {
+				t.Errorf("invalid concurrency. Observed: %d, expected: %d", c, test.expected)
+			}
+		})
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	q := With(Options{MaxStackSize: 16, Preallocate: true})
+	defer q.Close()
+	var n int
+	q.call(func() { n = len(q.stack.items) })
+	if n != 16 {
+		t.Error("failed to preallocate the stack", n)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	process := func(q Queue) error {
+		return q.Do(func() {})
+	}
+
+	fake := &fakeQueue{err: ErrStackFull}
+	if err := process(fake); err != ErrStackFull || fake.calls != 1 {
+		t.Error("failed to use the fake queue", err, fake.calls)
+	}
+
+	s := New()
+	defer s.Close()
+	if err := process(s); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShadow(t *testing.T) {
+	candidate := Options{MaxStackSize: 2}
+	run := func(q *Stack) {
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 1; i <= 3; i++ {
+			go func() {
+				done, err := q.Wait()
+				if err == nil {
+					done()
+				}
+			}()
+
+			for q.Status().QueuedJobs+q.View().Dropped != i {
+			}
+		}
+
+		done()
+	}
+
+	live := With(candidate)
+	defer live.Close()
+	run(live)
+	for live.View().Completed != 3 {
+	}
+
+	q := With(Options{MaxStackSize: 1})
+	defer q.Close()
+	if s := q.ShadowStats(); s != (Stats{}) {
+		t.Error("unexpected shadow stats", s)
+	}
+
+	if err := q.Shadow(candidate); err != nil {
+		t.Fatal(err)
+	}
+
+	run(q)
+	var s Stats
+	for s.Completed != 3 {
+		s = q.ShadowStats()
+	}
+
+	v := live.View()
+	if s.Scheduled != v.Scheduled || s.Dropped != v.Dropped || s.TimedOut != v.TimedOut {
+		t.Error("shadow outcomes differ from the live run", s, v.Scheduled, v.Dropped, v.TimedOut)
+	}
+
+	if v := q.View(); v.Dropped != 2 {
+		t.Error("the shadow affected the stack", v.Dropped)
+	}
+
+	q.Close()
+	if err := q.Shadow(candidate); err != ErrClosed {
+		t.Error("failed to fail after closed", err)
+	}
+}
+
+func TestDrainStats(t *testing.T) {
+	c := &testClock{now: time.Now()}
+	q := withClock(Options{MaxStackSize: 1}, c.get)
+	defer q.CloseForced()
+
+	start := c.get()
+	for i := 0; i < 2; i++ {
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done()
+	}
+
+	c.advance(time.Minute)
+	stats := q.DrainStats()
+	if stats != (Stats{Since: start, Scheduled: 2, Completed: 2}) {
+		t.Error("invalid stats", stats)
+	}
+
+	if _, err := q.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	go q.Wait()
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	go q.Wait()
+	for {
+		if _, ok := q.LastShed(); ok {
+			break
+		}
+	}
+
+	stats = q.DrainStats()
+	if stats != (Stats{Since: start.Add(time.Minute), Scheduled: 1, Dropped: 1, DroppedByOverload: 1}) {
+		t.Error("invalid stats after drain", stats)
+	}
+
+	if v := q.View(); v.Scheduled != 3 || v.Dropped != 1 {
+		t.Error("failed to keep the total counters", v.Scheduled, v.Dropped)
+	}
+}
+
+func TestSnapshotStatus(t *testing.T) {
+	q := With(Options{MaxConcurrency: 2, SnapshotStatus: true})
+	if s := q.Status(); s != (Status{}) {
+		t.Fatal("invalid initial status", s)
+	}
+
+	for i := 0; i < 3; i++ {
+		go q.Wait()
+	}
+
+	for {
+		if s := q.Status(); s.ActiveJobs == 2 && s.QueuedJobs == 1 {
+			break
+		}
+	}
+
+	q.CloseForced()
+	<-q.hasQuit
+	if s := q.Status(); !s.Closed {
+		t.Error("failed to report closed", s)
+	}
+}
+
+func TestIntakeBuffer(t *testing.T) {
+	t.Run("burst", func(t *testing.T) {
+		q := With(Options{MaxConcurrency: 3, IntakeBuffer: 16})
+		defer q.Close()
+		var (
+			wg       sync.WaitGroup
+			executed int64
+		)
+
+		for i := 0; i < 120; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := q.Do(func() { atomic.AddInt64(&executed, 1) }); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+
+		wg.Wait()
+		if executed != 120 {
+			t.Error("failed to execute all the jobs", executed)
+		}
+
+		if v := q.View(); v.Scheduled != 120 || v.Completed != 120 {
+			t.Error("invalid counters", v.Scheduled, v.Completed)
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		q := With(Options{MaxStackSize: 1, IntakeBuffer: 16})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		results := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				done, err := q.Wait()
+				if err == nil {
+					done()
+				}
+
+				results <- err
+			}()
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := <-results; err != ErrStackFull {
+				t.Error("failed to drop", err)
+			}
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		q := With(Options{IntakeBuffer: 16})
+		if _, err := q.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := q.Wait(); !errors.Is(err, ErrClosed) {
+					t.Error("failed to fail with closed", err)
+				}
+			}()
+		}
+
+		q.CloseForced()
+		wg.Wait()
+		if _, err := q.Wait(); err != ErrClosed {
+			t.Error("failed to fail with closed", err)
+		}
+	})
+}
+
+func BenchmarkIntakeBuffer(b *testing.B) {
+	for _, size := range []int{0, 16, 256} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			q := With(Options{MaxConcurrency: 4, IntakeBuffer: size})
+			defer q.Close()
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					q.Do(func() {})
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStatus(b *testing.B) {
+	for _, snapshot := range []bool{false, true} {
+		title := "control loop"
+		if snapshot {
+			title = "snapshot"
+		}
+
+		b.Run(title, func(b *testing.B) {
+			q := With(Options{MaxConcurrency: 4, SnapshotStatus: snapshot})
+			defer q.Close()
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							q.Do(func() {})
+						}
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					q.Status()
+				}
+			})
+
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestWaitSeq(t *testing.T) {
+	pending := func(q *Stack) int {
+		var n int
+		q.call(func() { n = len(q.seqPending) })
+		return n
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		q := With(Options{ScheduleOrder: ScheduleFIFO, SequenceTimeout: time.Minute})
+		defer q.Close()
+
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		order := make(chan uint64, 3)
+		for i, seq := range []uint64{2, 1, 0} {
+			go func(seq uint64) {
+				done, err := q.WaitSeq(seq)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				order <- seq
+				done()
+			}(seq)
+
+			if i < 2 {
+				for pending(q) != i+1 {
+				}
+			}
+		}
+
+		for q.Status().QueuedJobs != 3 {
+		}
+
+		done()
+		for i := uint64(0); i < 3; i++ {
+			if seq := <-order; seq != i {
+				t.Error("invalid order", seq, i)
+			}
+		}
+	})
+
+	t.Run("skip missing", func(t *testing.T) {
+		q := With(Options{SequenceTimeout: 12 * time.Millisecond})
+		defer q.Close()
+
+		done, err := q.WaitSeq(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done()
+		if done, err = q.WaitSeq(0); err != nil {
+			t.Fatal(err)
+		}
+
+		done()
+	})
+
+	t.Run("flush on close", func(t *testing.T) {
+		q := With(Options{SequenceTimeout: time.Minute})
+		result := make(chan error)
+		go func() {
+			done, err := q.WaitSeq(1)
+			if err == nil {
+				done()
+			}
+
+			result <- err
+		}()
+
+		for pending(q) != 1 {
+		}
+
+		q.Close()
+		if err := <-result; err != nil {
+			t.Error("failed to process the held back job", err)
+		}
+
+		<-q.hasQuit
+	})
+}
+
+func TestQueueDepthHistogram(t *testing.T) {
+	q := With(Options{TrackQueueDepth: true})
+	defer q.CloseForced()
+	if err := q.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		go q.Wait()
+		for q.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	if err := q.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h := q.QueueDepthHistogram(); !reflect.DeepEqual(h, map[int]int{1: 2, 2: 1}) {
+		t.Error("invalid histogram", h)
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	t.Run("call after closed", func(t *testing.T) {
+		q := New()
+		q.Close()
+		<-q.hasQuit
+		_, err := q.Wait()
+		if err != ErrClosed {
+			t.Fail()
+		}
+	})
+
+	t.Run("call after closed while busy", func(t *testing.T) {
+		q := New()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		q.Close()
+		_, err = q.Wait()
+		if err != ErrClosed {
+			t.Error("failed to report closed")
+		}
+	})
+
+	t.Run("jobs get processed", func(t *testing.T) {
+		q := New()
+		completeJobs := make(chan struct{})
+		for i := 0; i < 3; i++ {
+			go func() {
+				done, err := q.Wait()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				<-completeJobs
+				done()
+			}()
+		}
+
+		for {
+			s := q.Status()
+			if s.ActiveJobs+s.QueuedJobs == 3 {
+				break
+			}
+		}
+
+		q.Close()
+		close(completeJobs)
+		<-q.hasQuit
+	})
+
+	t.Run("teardown timeout", func(t *testing.T) {
+		q := With(Options{CloseTimeout: 12 * time.Millisecond})
+
+		_, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				_, err := q.Wait()
+				if err != ErrClosedWhileQueued {
+					t.Error("failed to fail with ErrClosedWhileQueued")
+				}
+
+				wg.Done()
+			}()
+		}
+
+		for {
+			s := q.Status()
+			if s.ActiveJobs+s.QueuedJobs == 3 {
+				break
+			}
+		}
+
+		q.Close()
+		wg.Wait()
+	})
+
+	t.Run("reject new jobs while draining", func(t *testing.T) {
+		q := With(Options{CloseTimeout: time.Second})
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		queued := make(chan error)
+		go func() {
+			done, err := q.Wait()
+			if err == nil {
+				done()
+			}
+
+			queued <- err
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		q.Close()
+		for i := 0; i < 3; i++ {
+			if _, err := q.Wait(); err != ErrClosed {
+				t.Error("failed to reject while draining", err)
+			}
+		}
+
+		done()
+		if err := <-queued; err != nil {
+			t.Error("failed to drain the queued job", err)
+		}
+
+		<-q.hasQuit
+	})
+
+	t.Run("reject new jobs when the close timeout passes", func(t *testing.T) {
+		q := With(Options{CloseTimeout: time.Millisecond})
+		if _, err := q.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		q.Close()
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					_, err := q.Wait()
+					if err != ErrClosed {
+						t.Error("failed to reject", err)
+						return
+					}
+
+					select {
+					case <-q.hasQuit:
+						return
+					default:
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+	})
+
+	t.Run("close within", func(t *testing.T) {
+		q := New()
+		if _, err := q.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		queued := make(chan error)
+		go func() {
+			_, err := q.Wait()
+			queued <- err
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		q.CloseWithin(12 * time.Millisecond)
+		if err := <-queued; err != ErrClosedWhileQueued {
+			t.Error("failed to fail with ErrClosedWhileQueued", err)
+		}
+
+		<-q.hasQuit
+	})
+}
+
+func TestClosed(t *testing.T) {
+	q := New()
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Close()
+	select {
+	case <-q.Closed():
+		t.Fatal("closed before the active job was done")
+	case <-time.After(15 * time.Millisecond):
+	}
+
+	done()
+	select {
+	case <-q.Closed():
+	case <-time.After(120 * time.Millisecond):
+		t.Error("failed to signal closed")
+	}
+}
+
+func acquireForDebug(q *Stack) (func(), error) {
+	return q.Wait()
+}
+
+func TestActiveHolders(t *testing.T) {
+	q := With(Options{Debug: true})
+	defer q.Close()
+	done, err := acquireForDebug(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holders := q.ActiveHolders()
+	if len(holders) != 1 || !strings.Contains(holders[0], "acquireForDebug") {
+		t.Fatal("failed to report holder", holders)
+	}
+
+	done()
+	for len(q.ActiveHolders()) != 0 {
+	}
+
+	qn := New()
+	defer qn.Close()
+	done, err = qn.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer done()
+	if holders := qn.ActiveHolders(); holders != nil {
+		t.Error("unexpected holders without debug", holders)
+	}
+}
+
+func TestMaxTotalJobs(t *testing.T) {
+	q := With(Options{MaxConcurrency: 2, MaxTotalJobs: 3})
+	defer q.Close()
+
+	release := make(chan struct{})
+	results := make(chan error, 5)
+	var executed int64
+	for i := 0; i < 5; i++ {
+		go func() {
+			results <- q.Do(func() {
+				atomic.AddInt64(&executed, 1)
+				<-release
+			})
+		}()
+	}
+
+	for {
+		s := q.Status()
+		if s.ActiveJobs == 2 && s.QueuedJobs == 3 {
+			break
+		}
+	}
+
+	close(release)
+	var failed int
+	for i := 0; i < 5; i++ {
+		if err := <-results; err != nil {
+			if !errors.Is(err, ErrClosed) {
+				t.Error("unexpected error", err)
+			}
+
+			failed++
+		}
+	}
+
+	if executed != 3 || failed != 2 {
+		t.Error("invalid number of executed jobs", executed, failed)
+	}
+
+	<-q.Closed()
+	if err := q.Do(func() {}); err != ErrClosed {
+		t.Error("failed to close", err)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	q := With(Options{MaxLifetime: 15 * time.Millisecond})
+	defer q.Close()
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := q.Wait(); err != ErrClosed {
+		t.Error("failed to close after the lifetime", err)
+	}
+
+	select {
+	case <-q.Closed():
+		t.Fatal("closed before the active job was done")
+	default:
+	}
+
+	done()
+	select {
+	case <-q.Closed():
+	case <-time.After(120 * time.Millisecond):
+		t.Error("failed to finish closing")
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	start := func(d time.Duration) []*Stack {
+		var stacks []*Stack
+		for i := 0; i < 3; i++ {
+			q := New()
+			done, err := q.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			time.AfterFunc(d, done)
+
+			stacks = append(stacks, q)
+		}
+
+		return stacks
+	}
+
+	t.Run("all closed", func(t *testing.T) {
+		stacks := start(3 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+		defer cancel()
+		if err := CloseAll(ctx, stacks...); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, q := range stacks {
+			select {
+			case <-q.Closed():
+			default:
+				t.Error("failed to close stack")
+			}
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		stacks := start(time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Millisecond)
+		defer cancel()
+		if err := CloseAll(ctx, stacks...); err != context.DeadlineExceeded {
+			t.Fatal("failed to fail with the context error", err)
+		}
+
+		for _, q := range stacks {
+			select {
+			case <-q.Closed():
+			default:
+				t.Error("failed to force close stack")
+			}
+		}
+	})
+}
+
+func TestClosedWhileQueued(t *testing.T) {
+	q := New()
+	if _, err := q.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := make(chan error)
+	go func() {
+		_, err := q.Wait()
+		queued <- err
+	}()
+
+	for q.Status().QueuedJobs != 1 {
+	}
+
+	q.CloseForced()
+	if err := <-queued; !errors.Is(err, ErrClosedWhileQueued) || !errors.Is(err, ErrClosed) {
+		t.Error("failed to fail with ErrClosedWhileQueued", err)
+	}
+
+	_, err := q.Wait()
+	if !errors.Is(err, ErrClosed) || errors.Is(err, ErrClosedWhileQueued) {
+		t.Error("failed to fail with ErrClosed", err)
+	}
+}
+
+func TestOnShutdownJob(t *testing.T) {
+	var shutdown []interface{}
+	q := With(Options{OnShutdownJob: func(meta interface{}) { shutdown = append(shutdown, meta) }})
+	if _, err := q.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := q.WaitMeta(i); err != ErrClosedWhileQueued {
+				t.Error("failed to fail with ErrClosedWhileQueued", err)
+			}
+		}(i)
+
+		for q.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	q.CloseForced()
+	wg.Wait()
+	<-q.hasQuit
+	if !reflect.DeepEqual(shutdown, []interface{}{0, 1}) {
+		t.Error("failed to receive the queued jobs", shutdown)
+	}
+}
+
+func TestForcedTeardown(t *testing.T) {
+	t.Run("queued jobs get canceled", func(t *testing.T) {
+		q := New()
+
+		_, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				_, err := q.Wait()
+				if err != ErrClosedWhileQueued {
+					t.Error("failed to fail with ErrClosedWhileQueued")
+				}
+
+				wg.Done()
+			}()
+		}
+
+		for {
+			s := q.Status()
+			if s.ActiveJobs+s.QueuedJobs == 3 {
+				break
+			}
+		}
+
+		q.CloseForced()
+		wg.Wait()
+	})
+
+	t.Run("processed jobs done is a noop", func(t *testing.T) {
+		q := New()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q.CloseForced()
+		<-q.hasQuit
+		done()
+	})
+
+	t.Run("acknowledged done", func(t *testing.T) {
+		q := New()
+		done, err := q.WaitAck()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !done() {
+			t.Error("failed to acknowledge the release")
+		}
+
+		done, err = q.WaitAck()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q.CloseForced()
+		<-q.hasQuit
+		if done() {
+			t.Error("failed to report ignored release")
+		}
+	})
+
+	t.Run("forced close after normal close", func(t *testing.T) {
+		q := New()
+
+		_, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				_, err := q.Wait()
+				if err != ErrClosedWhileQueued {
+					t.Error("failed to fail with ErrClosedWhileQueued")
+				}
+
+				wg.Done()
+			}()
+		}
+
+		for {
+			s := q.Status()
+			if s.ActiveJobs+s.QueuedJobs == 3 {
+				break
+			}
+		}
+
+		q.Close()
+		q.Status() // call status to make sure that we entered the control loop
+		q.CloseForced()
+		wg.Wait()
+	})
+}
+
+func TestDrainRunningTeardown(t *testing.T) {
+	q := With(Options{MaxConcurrency: 2})
+	completeJobs := make(chan struct{})
+	var running sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		running.Add(1)
+		go func() {
+			done, err := q.Wait()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			<-completeJobs
+			done()
+			running.Done()
+		}()
+	}
+
+	for q.Status().ActiveJobs != 2 {
+	}
+
+	var queued sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		queued.Add(1)
+		go func() {
+			_, err := q.Wait()
+			if err != ErrClosedWhileQueued {
+				t.Error("failed to fail with ErrClosedWhileQueued")
+			}
+
+			queued.Done()
+		}()
+	}
+
+	for {
+		s := q.Status()
+		if s.ActiveJobs == 2 && s.QueuedJobs == 2 {
+			break
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		q.CloseDrainRunning()
+		close(closed)
+	}()
+
+	queued.Wait()
+	select {
+	case <-closed:
+		t.Fatal("returned before the running jobs were done")
+	default:
+	}
+
+	close(completeJobs)
+	running.Wait()
+	<-closed
+}
+
+func TestMigrate(t *testing.T) {
+	q := New()
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mx      sync.Mutex
+		dropped int
+	)
+
+	completeJobs := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			err := q.Do(func() {
+				<-completeJobs
+			})
+
+			if err == ErrStackFull {
+				mx.Lock()
+				dropped++
+				mx.Unlock()
+			} else if err != nil {
+				t.Error(err)
+			}
+
+			wg.Done()
+		}()
+
+		for q.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	nq, err := q.Migrate(Options{MaxConcurrency: 2, MaxStackSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nq.Close()
+	for {
+		s := nq.Status()
+		if s.ActiveJobs == 2 && s.QueuedJobs == 1 {
+			break
+		}
+	}
+
+	if s := q.Status(); !s.Closing || s.ActiveJobs != 1 || s.QueuedJobs != 0 {
+		t.Error("unexpected status of the old stack", s)
+	}
+
+	if _, err := q.Wait(); err != ErrClosed {
+		t.Error("failed to close the old stack", err)
+	}
+
+	done()
+	<-q.hasQuit
+	close(completeJobs)
+	wg.Wait()
+	if dropped != 1 {
+		t.Error("failed to drop the job that didn't fit", dropped)
+	}
+
+	if _, err := q.Migrate(Options{}); err != ErrClosed {
+		t.Error("failed to fail after closed", err)
+	}
+
+	closing := New()
+	done, err = closing.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closing.Close()
+	if _, err := closing.Migrate(Options{}); err != ErrClosed {
+		t.Error("failed to fail while closing", err)
+	}
+
+	done()
+	<-closing.hasQuit
+
+	t.Run("close timeout", func(t *testing.T) {
+		q := With(Options{CloseTimeout: 12 * time.Millisecond})
+		if _, err := q.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		nq, err := q.Migrate(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer nq.Close()
+		select {
+		case <-q.hasQuit:
+		case <-time.After(120 * time.Millisecond):
+			t.Error("failed to apply the close timeout")
+		}
+	})
+}
+
+func TestExportQueued(t *testing.T) {
+	submit := func(q *Stack, meta []interface{}) {
+		for i, m := range meta {
+			go q.WaitMeta(m)
+			for q.Status().QueuedJobs != i+1 {
+			}
+		}
+	}
+
+	q := New()
+	defer q.CloseForced()
+	if err := q.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	submit(q, []interface{}{1, 2, 3})
+	exported := q.ExportQueued()
+	if !reflect.DeepEqual(exported, []interface{}{1, 2, 3}) {
+		t.Fatal("invalid export", exported)
+	}
+
+	restored := New()
+	defer restored.CloseForced()
+	if err := restored.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	submit(restored, exported)
+	if meta := restored.ExportQueued(); !reflect.DeepEqual(meta, exported) {
+		t.Error("failed to preserve order", meta)
+	}
+
+	q.CloseForced()
+	if meta := q.ExportQueued(); meta != nil {
+		t.Error("invalid export after closed", meta)
+	}
+}
+
+func TestSpillOnFull(t *testing.T) {
+	fill := func(t *testing.T, q *Stack) func() {
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			done, err := q.Wait()
+			if err == nil {
+				done()
+			}
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		return done
+	}
+
+	t.Run("spill accepts", func(t *testing.T) {
+		spill := New()
+		defer spill.Close()
+		q := With(Options{MaxStackSize: 1, EvictOrder: EvictNewest, SpillOnFull: spill})
+		defer q.Close()
+		defer fill(t, q)()
+
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s := spill.Status(); s.ActiveJobs != 1 {
+			t.Error("failed to execute on the spill stack", s.ActiveJobs)
+		}
+
+		done()
+		if s := spill.Status(); s.ActiveJobs != 0 {
+			t.Error("failed to release the spill stack", s.ActiveJobs)
+		}
+	})
+
+	t.Run("evicted job spills", func(t *testing.T) {
+		spill := New()
+		defer spill.Close()
+		q := With(Options{MaxStackSize: 1, SpillOnFull: spill})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		spilled := make(chan error)
+		go func() {
+			done, err := q.Wait()
+			if err == nil {
+				done()
+			}
+
+			spilled <- err
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		go func() {
+			done, err := q.Wait()
+			if err == nil {
+				done()
+			}
+		}()
+
+		if err := <-spilled; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("spill after a scheduler eviction", func(t *testing.T) {
+		spill := New()
+		defer spill.Close()
+		spillDone, err := spill.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := With(Options{MaxStackSize: 2, Scheduler: &WeightedFair{}, SpillOnFull: spill})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, weight := range []int{2, 1, 2} {
+			go func(weight int) {
+				done, err := q.WaitWeight(weight)
+				if err == nil {
+					done()
+				}
+			}(weight)
+
+			for q.Status().QueuedJobs+spill.Status().QueuedJobs != i+1 {
+			}
+		}
+
+		if queued := q.ExportQueued(); len(queued) != 2 {
+			t.Error("invalid queued jobs", len(queued))
+		}
+
+		done()
+		spillDone()
+	})
+
+	t.Run("both full", func(t *testing.T) {
+		spill := With(Options{MaxStackSize: 1, EvictOrder: EvictNewest})
+		defer spill.Close()
+		defer fill(t, spill)()
+		q := With(Options{MaxStackSize: 1, EvictOrder: EvictNewest, SpillOnFull: spill})
+		defer q.Close()
+		defer fill(t, q)()
+
+		if _, err := q.Wait(); err != ErrStackFull {
+			t.Error("failed to drop", err)
+		}
+	})
+}
+
+func TestFailover(t *testing.T) {
+	primary := New()
+	standby := New()
+	defer standby.Close()
+	if err := primary.Failover(standby); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := primary.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done, err := primary.Wait()
+			if err == nil {
+				done()
+			}
+
+			results <- err
+		}()
+
+		for primary.Status().QueuedJobs != i+1 {
+		}
+	}
+
+	primary.Close()
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v := standby.View(); v.Completed != 2 {
+		t.Fatal("failed to process the queued jobs on the standby", v.Completed)
+	}
+
+	_, err = primary.Wait()
+	var redirect *RedirectError
+	if !errors.As(err, &redirect) || redirect.Standby != standby || !errors.Is(err, ErrClosed) {
+		t.Fatal("failed to redirect", err)
+	}
+
+	done()
+	<-primary.hasQuit
+
+	if err := standby.Failover(standby); !errors.Is(err, ErrInvalidOptions) {
+		t.Error("failed to reject the stack as its own standby", err)
+	}
+
+	t.Run("timeout below the queued jobs of the standby", func(t *testing.T) {
+		primary := With(Options{Timeout: 20 * time.Millisecond})
+		standby := New()
+		defer standby.CloseForced()
+		if err := primary.Failover(standby); err != nil {
+			t.Fatal(err)
+		}
+
+		primaryDone, err := primary.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer primaryDone()
+		standbyDone, err := standby.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer standbyDone()
+		go standby.Wait()
+		for standby.Status().QueuedJobs != 1 {
+		}
+
+		timedOut := make(chan error)
+		go func() {
+			_, err := primary.Wait()
+			timedOut <- err
+		}()
+
+		for primary.Status().QueuedJobs != 1 {
+		}
+
+		primary.Close()
+		select {
+		case err := <-timedOut:
+			if !errors.Is(err, ErrTimeout) {
+				t.Error("failed to time out the moved job", err)
+			}
+		case <-time.After(200 * time.Millisecond):
+			t.Error("failed to enforce the timeout of the moved job")
+		}
+	})
+
+	t.Run("mutual standbys closed at once", func(t *testing.T) {
+		a, b := New(), New()
+		if err := a.Failover(b); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Failover(a); err != nil {
+			t.Fatal(err)
+		}
+
+		var dones []func()
+		results := make(chan error, 2)
+		for _, s := range []*Stack{a, b} {
+			done, err := s.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dones = append(dones, done)
+			go func(s *Stack) {
+				_, err := s.Wait()
+				results <- err
+			}(s)
+
+			for s.Status().QueuedJobs != 1 {
+			}
+		}
+
+		// hold the control loop of b, until a starts handing over its jobs,
+		// and then close b from inside its loop:
+		entered, release := make(chan struct{}), make(chan struct{})
+		go b.call(func() {
+			close(entered)
+			<-release
+			b.beginClose(closeGraceful)
+		})
+
+		<-entered
+		a.Close()
+		close(release)
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-results:
+				if !errors.Is(err, ErrClosedWhileQueued) {
+					t.Error("unexpected result of the moved job", err)
+				}
+			case <-time.After(200 * time.Millisecond):
+				t.Fatal("failed to hand over the jobs between the closing stacks")
+			}
+		}
+
+		for _, done := range dones {
+			done()
+		}
+
+		<-a.hasQuit
+		<-b.hasQuit
+	})
+}
+
+func TestPause(t *testing.T) {
+	q := With(Options{MaxConcurrency: 2})
+	defer q.CloseForced()
+
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Pause(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		go q.Wait()
+	}
+
+	for q.Status().QueuedJobs != 2 {
+	}
+
+	done()
+	for q.Status().ActiveJobs != 0 {
+	}
+
+	if s := q.Status(); !s.Paused || s.QueuedJobs != 2 {
+		t.Error("failed to pause", s)
+	}
+
+	if err := q.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := q.Status(); s.Paused || s.ActiveJobs != 2 || s.QueuedJobs != 0 {
+		t.Error("failed to resume", s)
+	}
 
-		q.Close()
-		wg.Wait()
-	})
-}
+	q.CloseForced()
+	if err := q.Pause(); err != ErrClosed {
+		t.Error("failed to fail after closed", err)
+	}
 
-func TestForcedTeardown(t *testing.T) {
-	t.Run("queued jobs get canceled", func(t *testing.T) {
+	t.Run("close while paused", func(t *testing.T) {
 		q := New()
-
-		_, err := q.Wait()
-		if err != nil {
+		if err := q.Pause(); err != nil {
 			t.Fatal(err)
 		}
 
-		var wg sync.WaitGroup
-		for i := 0; i < 2; i++ {
-			wg.Add(1)
-			go func() {
-				_, err := q.Wait()
-				if err != ErrClosed {
-					t.Error("failed to fail with ErrClosed")
-				}
-
-				wg.Done()
-			}()
-		}
+		errs := make(chan error)
+		go func() {
+			done, err := q.Wait()
+			done()
+			errs <- err
+		}()
 
-		for {
-			s := q.Status()
-			if s.ActiveJobs+s.QueuedJobs == 3 {
-				break
-			}
+		for q.Status().QueuedJobs != 1 {
 		}
 
-		q.CloseForced()
-		wg.Wait()
-	})
+		closed := make(chan struct{})
+		go func() {
+			q.Close()
+			close(closed)
+		}()
 
-	t.Run("processed jobs done is a noop", func(t *testing.T) {
-		q := New()
-		done, err := q.Wait()
-		if err != nil {
-			t.Fatal(err)
+		if err := <-errs; err != nil {
+			t.Error("failed to process the queued job", err)
 		}
 
-		q.CloseForced()
+		<-closed
 		<-q.hasQuit
-		done()
+		if err := q.Pause(); err != ErrClosed {
+			t.Error("failed to fail after closed", err)
+		}
 	})
+}
 
-	t.Run("forced close after normal close", func(t *testing.T) {
-		q := New()
+func TestOnDrained(t *testing.T) {
+	drained := make(chan struct{}, 3)
+	q := With(Options{OnDrained: func() { drained <- struct{}{} }})
+	defer q.Close()
 
-		_, err := q.Wait()
+	for batch := 0; batch < 2; batch++ {
+		done, err := q.Wait()
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		var wg sync.WaitGroup
-		for i := 0; i < 2; i++ {
+		for i := 0; i < 3; i++ {
 			wg.Add(1)
 			go func() {
-				_, err := q.Wait()
-				if err != ErrClosed {
-					t.Error("failed to fail with ErrClosed")
+				if err := q.Do(func() {}); err != nil {
+					t.Error(err)
 				}
 
 				wg.Done()
 			}()
 		}
 
-		for {
-			s := q.Status()
-			if s.ActiveJobs+s.QueuedJobs == 3 {
-				break
-			}
+		for q.Status().QueuedJobs != 3 {
 		}
 
-		q.Close()
-		q.Status() // call status to make sure that we entered the control loop
-		q.CloseForced()
+		done()
 		wg.Wait()
-	})
+		<-drained
+		for q.Status().ActiveJobs != 0 {
+		}
+	}
+
+	select {
+	case <-drained:
+		t.Error("unexpected drained notification")
+	default:
+	}
 }
 
 func TestStatus(t *testing.T) {
@@ -416,11 +3876,142 @@ func TestStatus(t *testing.T) {
 	})
 }
 
+func TestPendingReleases(t *testing.T) {
+	q := With(Options{MaxConcurrency: 2})
+	defer q.CloseForced()
+
+	var done []func()
+	for i := 0; i < 2; i++ {
+		d, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done = append(done, d)
+	}
+
+	// block the control loop by not receiving the status response:
+	hold := make(chan Status)
+	q.status <- hold
+
+	for _, d := range done {
+		go d()
+	}
+
+	for atomic.LoadInt64(&q.pendingReleases) != 2 {
+	}
+
+	<-hold
+	for q.Status().PendingReleases != 0 {
+	}
+
+	if s := q.Status(); s.ActiveJobs != 0 {
+		t.Error("failed to release the slots", s.ActiveJobs)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	t.Run("collect ticks", func(t *testing.T) {
+		q := New()
+		defer q.CloseForced()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		c, stop := q.Heartbeat(time.Millisecond)
+		for i := 0; i < 3; i++ {
+			if s := <-c; s.ActiveJobs != 1 {
+				t.Error("failed to deliver the right status")
+			}
+		}
+
+		stop()
+		stop()
+		for range c {
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		q := With(Options{MaxHeartbeatRate: 50})
+		defer q.Close()
+		var cs []<-chan Status
+		for i := 0; i < 3; i++ {
+			c, stop := q.Heartbeat(time.Millisecond)
+			defer stop()
+			cs = append(cs, c)
+		}
+
+		counts := make(chan int)
+		for _, c := range cs {
+			go func(c <-chan Status) {
+				var n int
+				timeout := time.After(100 * time.Millisecond)
+				for {
+					select {
+					case <-c:
+						n++
+					case <-timeout:
+						counts <- n
+						return
+					}
+				}
+			}(c)
+		}
+
+		for range cs {
+			if n := <-counts; n == 0 || n > 6 {
+				t.Error("failed to limit the heartbeat rate", n)
+			}
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		q := New()
+		c, stop := q.Heartbeat(time.Millisecond)
+		defer stop()
+		q.Close()
+		var last Status
+		for s := range c {
+			last = s
+		}
+
+		if !last.Closed {
+			t.Error("failed to deliver the closed status")
+		}
+	})
+
+	t.Run("non-positive interval", func(t *testing.T) {
+		q := New()
+		defer q.Close()
+		for _, interval := range []time.Duration{0, -time.Millisecond} {
+			c, stop := q.Heartbeat(interval)
+			if _, ok := <-c; ok {
+				t.Error("failed to close the channel", interval)
+			}
+
+			stop()
+			stop()
+		}
+
+		limited := With(Options{MaxHeartbeatRate: 500})
+		defer limited.Close()
+		c, stop := limited.Heartbeat(0)
+		defer stop()
+		if s, ok := <-c; !ok || s.Closed {
+			t.Error("failed to raise the interval to the rate limit")
+		}
+	})
+}
+
 func TestReconfigure(t *testing.T) {
 	waitForStatus := func(t *testing.T, q *Stack, s Status) {
 		timeout := time.After(120 * time.Millisecond)
 		for {
-			if q.Status() == s {
+			current := q.Status()
+			if current.ActiveJobs == s.ActiveJobs && current.QueuedJobs == s.QueuedJobs &&
+				current.Closing == s.Closing && current.Closed == s.Closed {
 				return
 			}
 
@@ -492,6 +4083,117 @@ func TestReconfigure(t *testing.T) {
 		}
 	})
 
+	t.Run("evicted by reconfigure", func(t *testing.T) {
+		q := With(Options{MaxStackSize: 2})
+		defer q.CloseForced()
+
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		results := make(chan error, 3)
+		submit := func() {
+			_, err := q.Wait()
+			results <- err
+		}
+
+		for i := 0; i < 2; i++ {
+			go submit()
+			for q.Status().QueuedJobs != i+1 {
+			}
+		}
+
+		go submit()
+		if err := <-results; err != ErrStackFull {
+			t.Fatal("failed to drop for the new arrival", err)
+		}
+
+		if err := q.ReconfigureSync(Options{MaxStackSize: 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := <-results; err != ErrEvictedByReconfigure || !errors.Is(err, ErrStackFull) {
+			t.Error("failed to evict by reconfigure", err)
+		}
+
+		if s := q.Status(); s.QueuedJobs != 1 {
+			t.Error("invalid queue", s.QueuedJobs)
+		}
+	})
+
+	t.Run("dropped counters", func(t *testing.T) {
+		q := With(Options{MaxStackSize: 3})
+		defer q.CloseForced()
+
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		results := make(chan error, 4)
+		submit := func() {
+			_, err := q.Wait()
+			results <- err
+		}
+
+		for i := 0; i < 3; i++ {
+			go submit()
+			for q.Status().QueuedJobs != i+1 {
+			}
+		}
+
+		if err := q.ReconfigureSync(Options{MaxStackSize: 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			<-results
+		}
+
+		s := q.Status()
+		if s.DroppedByReconfigure != 2 || s.DroppedByOverload != 0 {
+			t.Error("invalid counters after reconfigure", s.DroppedByReconfigure, s.DroppedByOverload)
+		}
+
+		go submit()
+		<-results
+		s = q.Status()
+		if s.DroppedByReconfigure != 2 || s.DroppedByOverload != 1 {
+			t.Error("invalid counters after overload", s.DroppedByReconfigure, s.DroppedByOverload)
+		}
+
+		stats := q.DrainStats()
+		if stats.Dropped != 3 || stats.DroppedByReconfigure != 2 || stats.DroppedByOverload != 1 {
+			t.Error("invalid stats", stats)
+		}
+	})
+
+	t.Run("infinite stack size after reconfigure", func(t *testing.T) {
+		q := With(Options{MaxStackSize: 2})
+		defer q.CloseForced()
+
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer done()
+		go q.Wait()
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		if err := q.ReconfigureSync(Options{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if s := q.Status(); s.QueuedJobs != 1 {
+			t.Error("failed to keep the queued job", s.QueuedJobs)
+		}
+	})
+
 	t.Run("use default concurrency", func(t *testing.T) {
 		q := With(Options{MaxConcurrency: 2, MaxStackSize: 2})
 		defer q.CloseForced()
@@ -502,6 +4204,85 @@ func TestReconfigure(t *testing.T) {
 		waitForStatus(t, q, Status{ActiveJobs: 1, QueuedJobs: 1})
 	})
 
+	t.Run("on reconfigure", func(t *testing.T) {
+		q := With(Options{MaxConcurrency: 2, MaxStackSize: 2})
+		defer q.CloseForced()
+
+		changes := make(chan [2]Options, 1)
+		onReconfigure := func(old, new Options) {
+			changes <- [2]Options{old, new}
+		}
+
+		if err := q.Reconfigure(Options{MaxStackSize: 3, OnReconfigure: onReconfigure}); err != nil {
+			t.Fatal(err)
+		}
+
+		c := <-changes
+		if c[0].MaxConcurrency != 2 || c[0].MaxStackSize != 2 {
+			t.Error("invalid old options", c[0].MaxConcurrency, c[0].MaxStackSize)
+		}
+
+		if c[1].MaxConcurrency != 1 || c[1].MaxStackSize != 3 {
+			t.Error("invalid new options", c[1].MaxConcurrency, c[1].MaxStackSize)
+		}
+	})
+
+	t.Run("count reconfigurations", func(t *testing.T) {
+		q := New()
+		defer q.CloseForced()
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if err := q.Reconfigure(Options{MaxConcurrency: i + 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s := q.Status()
+		if s.Reconfigurations != 3 {
+			t.Error("failed to count the reconfigurations", s.Reconfigurations)
+		}
+
+		if s.LastReconfigure.Before(start) {
+			t.Error("failed to record the last reconfiguration time")
+		}
+	})
+
+	t.Run("strict mode", func(t *testing.T) {
+		q := With(Options{MaxConcurrency: 2, MaxStackSize: 2, Strict: true})
+		defer q.CloseForced()
+
+		err := q.Reconfigure(Options{MaxConcurrency: 0, MaxStackSize: 2})
+		if !errors.Is(err, ErrInvalidOptions) {
+			t.Fatal("failed to reject invalid options", err)
+		}
+
+		if !strings.Contains(err.Error(), "Pause") {
+			t.Error("failed to suggest Pause", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			go q.Wait()
+		}
+
+		waitForStatus(t, q, Status{ActiveJobs: 2, QueuedJobs: 1})
+	})
+
+	t.Run("zero concurrency does not stop scheduling", func(t *testing.T) {
+		q := With(Options{MaxConcurrency: 2})
+		defer q.CloseForced()
+
+		if err := q.Reconfigure(Options{MaxConcurrency: 0}); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			go q.Wait()
+		}
+
+		waitForStatus(t, q, Status{ActiveJobs: 1, QueuedJobs: 1})
+	})
+
 	t.Run("reconfigure after closed", func(t *testing.T) {
 		q := New()
 		q.Close()
@@ -510,4 +4291,28 @@ func TestReconfigure(t *testing.T) {
 			t.Error("failed to fail")
 		}
 	})
+
+	t.Run("sync", func(t *testing.T) {
+		q := New()
+		defer q.CloseForced()
+		for i := 0; i < 3; i++ {
+			go q.Wait()
+		}
+
+		for q.Status().QueuedJobs != 2 {
+		}
+
+		if err := q.ReconfigureSync(Options{MaxConcurrency: 2, MaxStackSize: 5}); err != nil {
+			t.Fatal(err)
+		}
+
+		if s := q.Status(); s.ActiveJobs != 2 || s.QueuedJobs != 1 || s.Reconfigurations != 1 {
+			t.Error("failed to apply the options", s)
+		}
+
+		q.CloseForced()
+		if err := q.ReconfigureSync(Options{}); err != ErrClosed {
+			t.Error("failed to fail after closed", err)
+		}
+	})
 }
@@ -0,0 +1,64 @@
+package jobqueue
+
+import "fmt"
+
+var errPipelineJobs = fmt.Errorf("%w: more jobs than pipeline stages", ErrInvalidOptions)
+
+// Pipeline enforces the concurrency limits of multiple stacks, one for each
+// stage of a multi-stage operation.
+type Pipeline struct {
+	stages []*Stack
+}
+
+// NewPipeline creates a pipeline from the stacks of the stages, in the order of
+// the stages. The stacks are owned by the caller, and they need to be closed
+// separately.
+func NewPipeline(stages ...*Stack) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+// Do executes the jobs one after the other, each job in the slot of the stack
+// of the corresponding stage. When a job returns, Do acquires the slot of the
+// next stage before releasing the slot of the previous one, handing off the
+// work, so that a slower stage applies back pressure on the previous stages.
+//
+// The slots are always acquired in the order of the stages, and a slot of a
+// stage is held only while waiting for the next stage, so the pipelines
+// sharing the stacks in the same order cannot deadlock. Sharing the stacks in
+// different orders, however, can lead to a deadlock.
+//
+// When a stage returns an error, e.g. ErrStackFull, Do releases the slot held
+// by the previous stage, and returns the error. The remaining jobs are not
+// executed. It is invalid to pass in more jobs than the number of the stages.
+func (p *Pipeline) Do(jobs ...func()) error {
+	if len(jobs) > len(p.stages) {
+		return errPipelineJobs
+	}
+
+	for _, job := range jobs {
+		if job == nil {
+			return ErrNilJob
+		}
+	}
+
+	var release func()
+	for i, job := range jobs {
+		done, err := p.stages[i].Wait()
+		if release != nil {
+			release()
+		}
+
+		if err != nil {
+			return err
+		}
+
+		job()
+		release = done
+	}
+
+	if release != nil {
+		release()
+	}
+
+	return nil
+}
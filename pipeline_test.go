@@ -0,0 +1,66 @@
+package jobqueue
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	t.Run("limits each stage", func(t *testing.T) {
+		first := With(Options{MaxConcurrency: 1})
+		defer first.Close()
+		second := With(Options{MaxConcurrency: 3})
+		defer second.Close()
+		p := NewPipeline(first, second)
+
+		var c1, c2 jobCounter
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := p.Do(
+					func() { c1.do(time.Millisecond) },
+					func() { c2.do(9 * time.Millisecond) },
+				); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+
+		wg.Wait()
+		if c1.maxJobs != 1 {
+			t.Errorf("failed to limit the first stage. Observed: %d, expected: %d", c1.maxJobs, 1)
+		}
+
+		if c2.maxJobs < 2 || c2.maxJobs > 3 {
+			t.Errorf("failed to limit the second stage. Observed: %d, expected: 2-3", c2.maxJobs)
+		}
+	})
+
+	t.Run("stage error", func(t *testing.T) {
+		first := New()
+		defer first.Close()
+		second := New()
+		second.Close()
+		p := NewPipeline(first, second)
+
+		var executed bool
+		if err := p.Do(func() {}, func() { executed = true }); err != ErrClosed || executed {
+			t.Error("failed to fail", err, executed)
+		}
+
+		if s := first.Status(); s.ActiveJobs != 0 {
+			t.Error("failed to release the first stage", s.ActiveJobs)
+		}
+	})
+
+	t.Run("invalid jobs", func(t *testing.T) {
+		p := NewPipeline()
+		if err := p.Do(func() {}); !errors.Is(err, ErrInvalidOptions) {
+			t.Error("failed to fail", err)
+		}
+	})
+}
@@ -1,50 +1,172 @@
 package jobqueue
 
-import "container/list"
+// maxDepthBuckets limits the number of the buckets of the depth histogram, when
+// the stack size is infinite or larger.
+const maxDepthBuckets = 1024
 
+// stack holds the waiting jobs in a ring buffer. New jobs are pushed to the
+// top, and the jobs can be taken from both the top and the bottom. Jobs can be
+// removed from the middle, too, in which case they are only marked as removed,
+// and their place is freed once they get to one of the ends.
 type stack struct {
-	cap  int
-	list *list.List
+	cap         int
+	items       []*job
+	first       int
+	used        int
+	count       int
+	bytes       int
+	trackDepths bool
+	depths      map[int]int
 }
 
 func newStack(cap int) *stack {
-	return &stack{
-		cap:  cap,
-		list: list.New(),
+	return &stack{cap: cap}
+}
+
+// preallocate grows the ring buffer in advance, to hold n jobs without
+// further allocations.
+func (s *stack) preallocate(n int) {
+	if n > len(s.items) {
+		s.items = make([]*job, n)
 	}
 }
 
+func (s *stack) size() int {
+	return s.count
+}
+
 func (s *stack) empty() bool {
-	return s.list.Len() == 0
+	return s.count == 0
 }
 
 func (s *stack) full() bool {
-	return s.cap > 0 && s.list.Len() == s.cap
+	return s.cap > 0 && s.count >= s.cap
+}
+
+// observe records the current depth of the stack in the histogram, when
+// enabled.
+func (s *stack) observe() {
+	if !s.trackDepths {
+		return
+	}
+
+	limit := s.cap
+	if limit <= 0 || limit > maxDepthBuckets {
+		limit = maxDepthBuckets
+	}
+
+	d := s.count
+	if d > limit {
+		d = limit
+	}
+
+	if s.depths == nil {
+		s.depths = make(map[int]int)
+	}
+
+	s.depths[d]++
+}
+
+func (s *stack) index(i int) int {
+	return (s.first + i) % len(s.items)
+}
+
+func (s *stack) grow() {
+	n := 2 * s.count
+	if n < 8 {
+		n = 8
+	}
+
+	items := make([]*job, n)
+	var c int
+	for i := 0; i < s.used; i++ {
+		if j := s.items[s.index(i)]; j.stacked {
+			items[c] = j
+			c++
+		}
+	}
+
+	s.items = items
+	s.first = 0
+	s.used = c
+}
+
+// trim drops the removed jobs from the ends.
+func (s *stack) trim() {
+	for s.used > 0 && !s.items[s.first].stacked {
+		s.items[s.first] = nil
+		s.first = s.index(1)
+		s.used--
+	}
+
+	for s.used > 0 && !s.items[s.index(s.used-1)].stacked {
+		s.items[s.index(s.used-1)] = nil
+		s.used--
+	}
 }
 
 func (s *stack) bottom() *job {
-	if s.list.Len() == 0 {
+	if s.count == 0 {
 		return nil
 	}
 
-	return s.list.Back().Value.(*job)
+	return s.items[s.first]
+}
+
+// each iterates over the jobs from the top to the bottom, until f returns
+// false.
+func (s *stack) each(f func(*job) bool) {
+	for i := s.used - 1; i >= 0; i-- {
+		if j := s.items[s.index(i)]; j.stacked && !f(j) {
+			return
+		}
+	}
 }
 
 func (s *stack) push(j *job) {
-	j.entry = s.list.PushFront(j)
+	if s.used == len(s.items) {
+		s.grow()
+	}
+
+	j.stacked = true
+	s.items[s.index(s.used)] = j
+	s.used++
+	s.count++
+	s.bytes += j.size
+	s.observe()
 }
 
-func (s *stack) removeEntry(e *list.Element) *job {
-	s.list.Remove(e)
-	j := e.Value.(*job)
-	j.entry = nil
-	return j
+// unshift inserts a job at the bottom of the stack.
+func (s *stack) unshift(j *job) {
+	if s.used == len(s.items) {
+		s.grow()
+	}
+
+	j.stacked = true
+	s.first = s.index(len(s.items) - 1)
+	s.items[s.first] = j
+	s.used++
+	s.count++
+	s.bytes += j.size
+	s.observe()
+}
+
+func (s *stack) remove(j *job) {
+	j.stacked = false
+	s.count--
+	s.bytes -= j.size
+	s.observe()
+	s.trim()
 }
 
 func (s *stack) pop() *job {
-	return s.removeEntry(s.list.Front())
+	j := s.items[s.index(s.used-1)]
+	s.remove(j)
+	return j
 }
 
 func (s *stack) shift() *job {
-	return s.removeEntry(s.list.Back())
+	j := s.items[s.first]
+	s.remove(j)
+	return j
 }
@@ -0,0 +1,242 @@
+package jobqueue
+
+import (
+	"container/list"
+	"reflect"
+	"testing"
+)
+
+func TestStack(t *testing.T) {
+	s := newStack(0)
+	jobs := make([]*job, 20)
+	for i := range jobs {
+		jobs[i] = &job{}
+		s.push(jobs[i])
+	}
+
+	if s.size() != 20 || s.bottom() != jobs[0] {
+		t.Fatal("failed to push")
+	}
+
+	if s.pop() != jobs[19] || s.shift() != jobs[0] || s.bottom() != jobs[1] {
+		t.Fatal("failed to take from the ends")
+	}
+
+	for i := 1; i < 10; i++ {
+		if s.shift() != jobs[i] {
+			t.Fatal("failed to shift")
+		}
+
+		s.push(jobs[i])
+	}
+
+	for i := 9; i > 0; i-- {
+		if s.pop() != jobs[i] {
+			t.Fatal("failed to pop after wrapping around")
+		}
+	}
+
+	for i := 10; i < 19; i++ {
+		if s.shift() != jobs[i] {
+			t.Fatal("failed to shift after wrapping around")
+		}
+	}
+
+	if !s.empty() || s.bottom() != nil {
+		t.Error("failed to empty the stack")
+	}
+}
+
+func TestStackRemove(t *testing.T) {
+	s := newStack(0)
+	jobs := make([]*job, 5)
+	for i := range jobs {
+		jobs[i] = &job{}
+		s.push(jobs[i])
+	}
+
+	s.remove(jobs[2])
+	s.remove(jobs[0])
+	if s.size() != 3 || s.bottom() != jobs[1] {
+		t.Fatal("failed to remove")
+	}
+
+	s.remove(jobs[3])
+	if s.pop() != jobs[4] || s.pop() != jobs[1] || !s.empty() {
+		t.Error("failed to skip the removed jobs")
+	}
+
+	for i := 0; i < 20; i++ {
+		j := &job{}
+		s.push(j)
+		if i%2 == 0 {
+			s.remove(j)
+		}
+	}
+
+	if s.size() != 10 {
+		t.Error("failed to keep track of the jobs", s.size())
+	}
+}
+
+func TestStackUnshift(t *testing.T) {
+	s := newStack(0)
+	jobs := make([]*job, 12)
+	for i := range jobs {
+		jobs[i] = &job{}
+	}
+
+	for i := 6; i < 12; i++ {
+		s.push(jobs[i])
+	}
+
+	for i := 5; i >= 0; i-- {
+		s.unshift(jobs[i])
+	}
+
+	for i := range jobs {
+		if s.shift() != jobs[i] {
+			t.Fatal("failed to unshift", i)
+		}
+	}
+
+	if !s.empty() {
+		t.Error("failed to empty the stack")
+	}
+}
+
+func TestStackEach(t *testing.T) {
+	s := newStack(0)
+	jobs := make([]*job, 4)
+	for i := range jobs {
+		jobs[i] = &job{}
+		s.push(jobs[i])
+	}
+
+	s.remove(jobs[1])
+	var visited []*job
+	s.each(func(j *job) bool {
+		visited = append(visited, j)
+		return j != jobs[2]
+	})
+
+	if len(visited) != 2 || visited[0] != jobs[3] || visited[1] != jobs[2] {
+		t.Error("failed to iterate over the jobs")
+	}
+}
+
+func TestStackFull(t *testing.T) {
+	s := newStack(2)
+	s.push(&job{})
+	if s.full() {
+		t.Error("unexpected full stack")
+	}
+
+	s.push(&job{})
+	if !s.full() {
+		t.Error("failed to report full stack")
+	}
+}
+
+const churnSize = 1 << 10
+
+func TestStackDepths(t *testing.T) {
+	s := newStack(2)
+	s.trackDepths = true
+	for i := 0; i < 3; i++ {
+		s.push(&job{})
+	}
+
+	s.pop()
+	s.shift()
+	if !reflect.DeepEqual(s.depths, map[int]int{1: 2, 2: 3}) {
+		t.Error("invalid depths", s.depths)
+	}
+
+	untracked := newStack(2)
+	untracked.push(&job{})
+	if untracked.depths != nil {
+		t.Error("unexpected depths", untracked.depths)
+	}
+}
+
+func BenchmarkStackChurn(b *testing.B) {
+	b.Run("list", func(b *testing.B) {
+		l := list.New()
+		for i := 0; i < churnSize; i++ {
+			l.PushFront(&job{})
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			l.PushFront(&job{})
+			l.PushFront(&job{})
+			l.Remove(l.Front())
+			l.Remove(l.Back())
+		}
+	})
+
+	b.Run("ring", func(b *testing.B) {
+		s := newStack(0)
+		for i := 0; i < churnSize; i++ {
+			s.push(&job{})
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.push(&job{})
+			s.push(&job{})
+			s.pop()
+			s.shift()
+		}
+	})
+}
+
+func BenchmarkStackRemove(b *testing.B) {
+	s := newStack(0)
+	jobs := make([]*job, 1<<16)
+	for i := range jobs {
+		jobs[i] = &job{}
+		s.push(jobs[i])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := len(jobs)/4 + i%(len(jobs)/2)
+		s.remove(jobs[k])
+		jobs[k] = &job{}
+		s.push(jobs[k])
+	}
+}
+
+func BenchmarkStackBurst(b *testing.B) {
+	for _, preallocate := range []bool{false, true} {
+		name := "on-demand"
+		if preallocate {
+			name = "preallocated"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			jobs := make([]*job, churnSize)
+			for i := range jobs {
+				jobs[i] = &job{}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s := newStack(churnSize)
+				if preallocate {
+					s.preallocate(churnSize)
+				}
+
+				for _, j := range jobs {
+					s.push(j)
+				}
+			}
+		})
+	}
+}
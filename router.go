@@ -0,0 +1,144 @@
+package jobqueue
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Route defines a named queue of a Router.
+type Route struct {
+
+	// Name identifies the queue. It is used as the key in the status of the
+	// router, and it is matched against the result of the KeyFunc option of
+	// the router.
+	Name string
+
+	// Prefix defines the path prefix of the requests that are served by the
+	// queue, when the router doesn't have a KeyFunc.
+	Prefix string
+
+	// Options contains the configuration of the queue.
+	Options HTTPOptions
+}
+
+// RouterOptions contains the configuration of a Router.
+type RouterOptions struct {
+
+	// Routes defines the named queues of the router.
+	Routes []Route
+
+	// KeyFunc, when set, selects the queue of a request by returning its name.
+	// When not set, the queue is selected by the longest matching path
+	// prefix.
+	KeyFunc func(r *http.Request) string
+
+	// Default, when set, defines the queue used for the requests that don't
+	// match any route. It is reported in the status of the router with an
+	// empty name. When not set, the unmatched requests bypass the queues.
+	Default *HTTPOptions
+}
+
+type route struct {
+	name    string
+	prefix  string
+	handler *Handler
+}
+
+// Router serves multiple APIs with different throttling needs, each with its
+// own stack, behind a single http.Handler.
+type Router struct {
+	routes   []route
+	keyFunc  func(*http.Request) string
+	fallback http.Handler
+}
+
+// NewRouter initializes a Router, creating a separate stack for each route,
+// wrapping the same http.Handler argument. When the http.Handler argument is
+// nil, the routes use their DefaultHandler option, and the unmatched requests
+// bypassing the queues receive 404 Not Found.
+//
+// Instances of the Router need to be closed with the Close method once they
+// are not used anymore.
+func NewRouter(o RouterOptions, h http.Handler) *Router {
+	r := &Router{keyFunc: o.KeyFunc}
+	for _, ro := range o.Routes {
+		r.routes = append(r.routes, route{
+			name:    ro.Name,
+			prefix:  ro.Prefix,
+			handler: NewHandler(ro.Options, h),
+		})
+	}
+
+	if o.Default != nil {
+		r.fallback = NewHandler(*o.Default, h)
+	} else if h != nil {
+		r.fallback = h
+	} else {
+		r.fallback = nop404{}
+	}
+
+	return r
+}
+
+func (r *Router) match(req *http.Request) http.Handler {
+	if r.keyFunc != nil {
+		key := r.keyFunc(req)
+		for _, ro := range r.routes {
+			if ro.name == key {
+				return ro.handler
+			}
+		}
+
+		return r.fallback
+	}
+
+	var (
+		match  http.Handler
+		length = -1
+	)
+
+	for _, ro := range r.routes {
+		if strings.HasPrefix(req.URL.Path, ro.prefix) && len(ro.prefix) > length {
+			match = ro.handler
+			length = len(ro.prefix)
+		}
+	}
+
+	if match == nil {
+		return r.fallback
+	}
+
+	return match
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.match(req).ServeHTTP(w, req)
+}
+
+// Status returns the status of each queue, by the name of the route. The
+// default queue, when set, is reported with an empty name.
+func (r *Router) Status() map[string]Status {
+	s := make(map[string]Status)
+	for _, ro := range r.routes {
+		s[ro.name] = ro.handler.stack.Status()
+	}
+
+	if h, ok := r.fallback.(*Handler); ok {
+		s[""] = h.stack.Status()
+	}
+
+	return s
+}
+
+// Close frees up the resources used by the Router, closing the stacks of all
+// the routes.
+func (r *Router) Close() {
+	for _, ro := range r.routes {
+		ro.handler.Close()
+	}
+
+	if h, ok := r.fallback.(*Handler); ok {
+		h.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package jobqueue
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	foo, bar := &testHandler{}, &testHandler{}
+	mux := http.NewServeMux()
+	mux.Handle("/foo", foo)
+	mux.Handle("/bar", bar)
+	mux.Handle("/baz", &testHandler{})
+
+	r := NewRouter(RouterOptions{
+		Routes: []Route{{
+			Name:    "foo",
+			Prefix:  "/foo",
+			Options: HTTPOptions{Options: Options{MaxConcurrency: 1}},
+		}, {
+			Name:    "bar",
+			Prefix:  "/bar",
+			Options: HTTPOptions{Options: Options{MaxConcurrency: 2}},
+		}},
+	}, mux)
+
+	defer r.Close()
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			p := []string{"/foo", "/bar", "/baz"}[i%3]
+			if c, _ := mustGetSlow(t, s.URL+p, 9*time.Millisecond); c != http.StatusOK {
+				t.Error("unexpected status code", c)
+			}
+
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+	if foo.counter.maxJobs != 1 {
+		t.Errorf("failed to limit the concurrency of foo. Observed: %d, expected %d", foo.counter.maxJobs, 1)
+	}
+
+	if bar.counter.maxJobs != 2 {
+		t.Errorf("failed to limit the concurrency of bar. Observed: %d, expected %d", bar.counter.maxJobs, 2)
+	}
+
+	status := r.Status()
+	if len(status) != 2 || status["foo"].ActiveJobs != 0 || status["bar"].ActiveJobs != 0 {
+		t.Error("invalid status", status)
+	}
+}
+
+func TestRouterKeyFunc(t *testing.T) {
+	r := NewRouter(RouterOptions{
+		Routes:  []Route{{Name: "foo"}},
+		KeyFunc: func(r *http.Request) string { return r.Header.Get("X-Queue") },
+		Default: &HTTPOptions{},
+	}, nil)
+
+	defer r.Close()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Queue", "foo")
+	if h := r.match(req); h != r.routes[0].handler {
+		t.Error("failed to match by key")
+	}
+
+	req.Header.Set("X-Queue", "bar")
+	if h := r.match(req); h != r.fallback {
+		t.Error("failed to use the default queue")
+	}
+
+	if status := r.Status(); len(status) != 2 {
+		t.Error("failed to report the default queue", status)
+	}
+}
+
+func TestRouterDefaultHandler(t *testing.T) {
+	r := NewRouter(RouterOptions{
+		Routes: []Route{{
+			Name:   "foo",
+			Prefix: "/foo",
+			Options: HTTPOptions{DefaultHandler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})},
+		}},
+	}, nil)
+
+	defer r.Close()
+	s := httptest.NewServer(r)
+	defer s.Close()
+	if c, _ := mustGet(t, s.URL+"/foo"); c != http.StatusServiceUnavailable {
+		t.Error("failed to use the default handler of the route", c)
+	}
+
+	if c, _ := mustGet(t, s.URL+"/bar"); c != http.StatusNotFound {
+		t.Error("unexpected status code", c, "expected", http.StatusNotFound)
+	}
+}
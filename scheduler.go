@@ -0,0 +1,214 @@
+package jobqueue
+
+import "time"
+
+// QueuedJob represents a job waiting in a stack, as passed to a Scheduler.
+type QueuedJob struct {
+	job *job
+}
+
+// Scheduler defines the order in which the queued jobs of a stack are
+// scheduled and dropped, set with the Scheduler option. Its methods are called
+// from the control loop of the stack, so they should return fast, and they must
+// not call the methods of the stack.
+//
+// The scheduler is an optional side path of the stack: without it, the stack
+// uses its built-in order, and it doesn't fall back to LIFO. The stack calls
+// Pop when a slot frees up, and Evict when the stack is over MaxStackSize or
+// MaxQueuedBytes. When a job leaves the stack otherwise, e.g. when it times
+// out, gets canceled, is scheduled with ForceSchedule or moved to another
+// stack, the stack calls Remove, so that the scheduler doesn't keep it. The
+// timeouts are enforced in the order of the submission, independent of the
+// scheduler.
+type Scheduler interface {
+
+	// Push adds a job to the scheduler.
+	Push(QueuedJob)
+
+	// Pop removes and returns the job to be scheduled next.
+	Pop() QueuedJob
+
+	// Evict removes and returns the job to be dropped.
+	Evict() QueuedJob
+
+	// Remove removes a job that left the stack without being returned by Pop
+	// or Evict.
+	Remove(QueuedJob)
+
+	// Len returns the number of the jobs in the scheduler.
+	Len() int
+}
+
+// LIFO is a Scheduler that schedules the newest job first, and drops the
+// oldest one, the same way as the default order of the stack. It can be used
+// as the base of custom schedulers. The zero value is ready to use.
+type LIFO struct {
+	jobs []QueuedJob
+}
+
+// WeightedFair is a Scheduler that shares the free slots between the jobs of
+// different weights, submitted with WaitWeight, proportionally to their
+// weight, e.g. to give the premium clients a larger share of the concurrency.
+// Among the jobs of the same weight, the newest one is scheduled first. When a
+// job needs to be dropped, it drops the oldest job of the lowest weight. The
+// weights lower than 1 are treated as 1. The zero value is ready to use.
+type WeightedFair struct {
+	classes map[int][]QueuedJob
+	pass    map[int]float64
+	virtual float64
+	count   int
+}
+
+// Meta returns the metadata of the job, passed in with WaitMeta.
+func (j QueuedJob) Meta() interface{} {
+	return j.job.meta
+}
+
+// Estimate returns the expected duration of the job, passed in with
+// WaitEstimate.
+func (j QueuedJob) Estimate() time.Duration {
+	return j.job.estimate
+}
+
+// Weight returns the weight of the job, passed in with WaitWeight, or 1.
+func (j QueuedJob) Weight() int {
+	if j.job.weight < 1 {
+		return 1
+	}
+
+	return j.job.weight
+}
+
+// Submitted returns the time when the job was submitted to the stack.
+func (j QueuedJob) Submitted() time.Time {
+	return j.job.submitted
+}
+
+// Push adds a job on the top of the stack.
+func (l *LIFO) Push(j QueuedJob) {
+	l.jobs = append(l.jobs, j)
+}
+
+// Pop removes the newest job.
+func (l *LIFO) Pop() QueuedJob {
+	last := len(l.jobs) - 1
+	j := l.jobs[last]
+	l.jobs[last] = QueuedJob{}
+	l.jobs = l.jobs[:last]
+	return j
+}
+
+// Evict removes the oldest job.
+func (l *LIFO) Evict() QueuedJob {
+	j := l.jobs[0]
+	l.jobs[0] = QueuedJob{}
+	l.jobs = l.jobs[1:]
+	return j
+}
+
+// Remove removes a job.
+func (l *LIFO) Remove(j QueuedJob) {
+	for i := len(l.jobs) - 1; i >= 0; i-- {
+		if l.jobs[i].job == j.job {
+			copy(l.jobs[i:], l.jobs[i+1:])
+			l.jobs[len(l.jobs)-1] = QueuedJob{}
+			l.jobs = l.jobs[:len(l.jobs)-1]
+			return
+		}
+	}
+}
+
+// Len returns the number of the jobs.
+func (l *LIFO) Len() int {
+	return len(l.jobs)
+}
+
+// Push adds a job to the jobs of the same weight.
+func (w *WeightedFair) Push(j QueuedJob) {
+	if w.classes == nil {
+		w.classes = make(map[int][]QueuedJob)
+		w.pass = make(map[int]float64)
+	}
+
+	weight := j.Weight()
+	if len(w.classes[weight]) == 0 && w.pass[weight] < w.virtual {
+		w.pass[weight] = w.virtual
+	}
+
+	w.classes[weight] = append(w.classes[weight], j)
+	w.count++
+}
+
+// Pop removes the newest job of the weight that is the most behind its share.
+// The jobs that already left the stack are discarded, without counting them
+// in the share of their weight.
+func (w *WeightedFair) Pop() QueuedJob {
+	for {
+		next := 0
+		for weight, jobs := range w.classes {
+			if len(jobs) == 0 {
+				continue
+			}
+
+			if next == 0 || w.pass[weight] < w.pass[next] ||
+				w.pass[weight] == w.pass[next] && weight > next {
+				next = weight
+			}
+		}
+
+		if next == 0 {
+			return QueuedJob{}
+		}
+
+		jobs := w.classes[next]
+		last := len(jobs) - 1
+		j := jobs[last]
+		jobs[last] = QueuedJob{}
+		w.classes[next] = jobs[:last]
+		w.count--
+		if j.job != nil && !j.job.stacked {
+			continue
+		}
+
+		w.virtual = w.pass[next]
+		w.pass[next] += 1 / float64(next)
+		return j
+	}
+}
+
+// Evict removes the oldest job of the lowest weight.
+func (w *WeightedFair) Evict() QueuedJob {
+	lowest := 0
+	for weight, jobs := range w.classes {
+		if len(jobs) > 0 && (lowest == 0 || weight < lowest) {
+			lowest = weight
+		}
+	}
+
+	jobs := w.classes[lowest]
+	j := jobs[0]
+	jobs[0] = QueuedJob{}
+	w.classes[lowest] = jobs[1:]
+	w.count--
+	return j
+}
+
+// Remove removes a job, without changing the share of its weight.
+func (w *WeightedFair) Remove(j QueuedJob) {
+	weight := j.Weight()
+	jobs := w.classes[weight]
+	for i := len(jobs) - 1; i >= 0; i-- {
+		if jobs[i].job == j.job {
+			copy(jobs[i:], jobs[i+1:])
+			jobs[len(jobs)-1] = QueuedJob{}
+			w.classes[weight] = jobs[:len(jobs)-1]
+			w.count--
+			return
+		}
+	}
+}
+
+// Len returns the number of the jobs.
+func (w *WeightedFair) Len() int {
+	return w.count
+}
@@ -0,0 +1,322 @@
+package jobqueue
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fifoScheduler struct {
+	jobs []QueuedJob
+}
+
+func (f *fifoScheduler) Push(j QueuedJob) {
+	f.jobs = append(f.jobs, j)
+}
+
+func (f *fifoScheduler) Pop() QueuedJob {
+	j := f.jobs[0]
+	f.jobs = f.jobs[1:]
+	return j
+}
+
+func (f *fifoScheduler) Evict() QueuedJob {
+	j := f.jobs[len(f.jobs)-1]
+	f.jobs = f.jobs[:len(f.jobs)-1]
+	return j
+}
+
+func (f *fifoScheduler) Remove(j QueuedJob) {
+	for i := range f.jobs {
+		if f.jobs[i].job == j.job {
+			f.jobs = append(f.jobs[:i], f.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *fifoScheduler) Len() int {
+	return len(f.jobs)
+}
+
+func testScheduler(t *testing.T, s Scheduler, expectedOrder []int, expectedDropped int) {
+	order := make(chan interface{}, 3)
+	q := With(Options{
+		MaxStackSize: 2,
+		Scheduler:    s,
+		OnSchedule:   func(meta interface{}) { order <- meta },
+	})
+
+	defer q.Close()
+	done, err := q.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-order
+	results := make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		go func(i int) {
+			done, err := q.WaitMeta(i)
+			if err != nil {
+				results <- i
+				return
+			}
+
+			done()
+		}(i)
+
+		for q.Status().QueuedJobs != i && q.View().Dropped == 0 {
+		}
+	}
+
+	if dropped := <-results; dropped != expectedDropped {
+		t.Error("invalid dropped job", dropped, expectedDropped)
+	}
+
+	done()
+	var observed []int
+	for range expectedOrder {
+		observed = append(observed, (<-order).(int))
+	}
+
+	if !reflect.DeepEqual(observed, expectedOrder) {
+		t.Error("invalid order", observed, expectedOrder)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	t.Run("custom", func(t *testing.T) {
+		testScheduler(t, &fifoScheduler{}, []int{1, 2}, 3)
+	})
+
+	t.Run("lifo", func(t *testing.T) {
+		testScheduler(t, &LIFO{}, []int{3, 2}, 1)
+	})
+
+	t.Run("remove the jobs that left the stack", func(t *testing.T) {
+		s := &fifoScheduler{}
+		q := With(Options{Scheduler: s})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		canceled := make(chan struct{})
+		go func() {
+			q.WaitContext(ctx)
+			close(canceled)
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		cancel()
+		<-canceled
+		var n int
+		q.call(func() { n = s.Len() })
+		if n != 0 {
+			t.Error("failed to remove the canceled job from the scheduler", n)
+		}
+
+		result := make(chan error)
+		go func() {
+			done, err := q.Wait()
+			if err == nil {
+				done()
+			}
+
+			result <- err
+		}()
+
+		for q.Status().QueuedJobs != 1 {
+		}
+
+		done()
+		if err := <-result; err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSchedulerTimeouts(t *testing.T) {
+	for _, s := range []Scheduler{&LIFO{}, &WeightedFair{}} {
+		q := With(Options{Scheduler: s, Timeout: time.Millisecond})
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 12; i++ {
+			if _, err := q.Wait(); !errors.Is(err, ErrTimeout) {
+				t.Fatal("failed to time out the job", err)
+			}
+		}
+
+		var n int
+		q.call(func() { n = s.Len() })
+		if n != 0 {
+			t.Errorf("%T: failed to remove the timed out jobs: %d", s, n)
+		}
+
+		done()
+		q.Close()
+	}
+}
+
+func TestWeightedFair(t *testing.T) {
+	t.Run("share", func(t *testing.T) {
+		q := With(Options{Scheduler: &WeightedFair{}})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			mx    sync.Mutex
+			order []int
+			wg    sync.WaitGroup
+		)
+
+		for i := 0; i < 8; i++ {
+			weight := 1 + i%2*2
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				done, err := q.WaitWeight(weight)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mx.Lock()
+				order = append(order, weight)
+				mx.Unlock()
+				done()
+			}()
+
+			for q.Status().QueuedJobs != i+1 {
+			}
+		}
+
+		done()
+		wg.Wait()
+		expected := []int{3, 1, 3, 3, 3, 1, 1, 1}
+		if !reflect.DeepEqual(order, expected) {
+			t.Error("invalid order", order, expected)
+		}
+	})
+
+	t.Run("timeouts in one weight class", func(t *testing.T) {
+		q := With(Options{Scheduler: &WeightedFair{}, Timeout: 30 * time.Millisecond})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 6; i++ {
+			if _, err := q.WaitWeight(1); !errors.Is(err, ErrTimeout) {
+				t.Fatal("failed to time out the job", err)
+			}
+		}
+
+		var (
+			mx    sync.Mutex
+			order []int
+			wg    sync.WaitGroup
+		)
+
+		for i := 0; i < 4; i++ {
+			weight := 1 + i%2*2
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				done, err := q.WaitWeight(weight)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mx.Lock()
+				order = append(order, weight)
+				mx.Unlock()
+				done()
+			}()
+
+			for q.Status().QueuedJobs != i+1 {
+			}
+		}
+
+		done()
+		wg.Wait()
+		expected := []int{3, 1, 3, 1}
+		if !reflect.DeepEqual(order, expected) {
+			t.Error("invalid order", order, expected)
+		}
+	})
+
+	t.Run("discard the jobs that left the stack", func(t *testing.T) {
+		w := &WeightedFair{}
+		live := func(weight int) QueuedJob {
+			return QueuedJob{job: &job{weight: weight, stacked: true}}
+		}
+
+		w.Push(live(1))
+		w.Push(live(3))
+		for i := 0; i < 3; i++ {
+			w.Push(QueuedJob{job: &job{weight: 1}})
+		}
+
+		w.Push(live(3))
+		var order []int
+		for w.Len() > 0 {
+			if j := w.Pop(); j.job != nil {
+				j.job.stacked = false
+				order = append(order, j.Weight())
+			}
+		}
+
+		expected := []int{3, 1, 3}
+		if !reflect.DeepEqual(order, expected) {
+			t.Error("invalid order", order, expected)
+		}
+	})
+
+	t.Run("evict lowest weight", func(t *testing.T) {
+		q := With(Options{MaxStackSize: 2, Scheduler: &WeightedFair{}})
+		defer q.Close()
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results := make(chan int, 3)
+		for i, weight := range []int{1, 3, 3} {
+			go func(weight int) {
+				done, err := q.WaitWeight(weight)
+				if err != nil {
+					results <- weight
+					return
+				}
+
+				done()
+			}(weight)
+
+			for q.Status().QueuedJobs != i+1 && q.View().Dropped == 0 {
+			}
+		}
+
+		if dropped := <-results; dropped != 1 {
+			t.Error("invalid dropped job", dropped)
+		}
+
+		done()
+	})
+}
@@ -0,0 +1,95 @@
+package jobqueue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// StackView is a read-only snapshot of the state, the limits and the
+// cumulative counters of a stack, e.g. for rendering in an HTML template.
+type StackView struct {
+	Status
+
+	// MaxConcurrency contains the effective concurrency limit, including a
+	// possible boost. It is zero while paused.
+	MaxConcurrency int
+
+	// MaxStackSize contains the configured stack size. Zero means infinite.
+	MaxStackSize int
+
+	// Timeout contains the configured timeout. Zero means infinite.
+	Timeout time.Duration
+
+	// Scheduled contains the number of the jobs scheduled since the stack
+	// was created.
+	Scheduled int
+
+	// Completed contains the number of the finished jobs.
+	Completed int
+
+	// Dropped contains the number of the jobs dropped with ErrStackFull.
+	Dropped int
+
+	// TimedOut contains the number of the jobs rejected with ErrTimeout.
+	TimedOut int
+
+	// AverageRunTime contains the moving average of the execution time of
+	// the recently finished jobs.
+	AverageRunTime time.Duration
+
+	// LastShed contains the time when the stack last dropped or timed out a
+	// job. Zero if it never happened.
+	LastShed time.Time
+}
+
+// SaturationPct returns the active jobs as the percentage of the effective
+// concurrency limit.
+func (v StackView) SaturationPct() float64 {
+	if v.MaxConcurrency == 0 {
+		return 0
+	}
+
+	return float64(v.ActiveJobs) * 100 / float64(v.MaxConcurrency)
+}
+
+// QueueFillPct returns the queued jobs as the percentage of the stack size. It
+// returns zero when the stack size is infinite.
+func (v StackView) QueueFillPct() float64 {
+	if v.MaxStackSize == 0 {
+		return 0
+	}
+
+	return float64(v.QueuedJobs) * 100 / float64(v.MaxStackSize)
+}
+
+func (s *Stack) view() StackView {
+	return StackView{
+		Status:         s.snapshot(),
+		MaxConcurrency: s.limit(),
+		MaxStackSize:   s.options.MaxStackSize,
+		Timeout:        s.options.Timeout,
+		Scheduled:      s.total.Scheduled,
+		Completed:      s.total.Completed,
+		Dropped:        s.total.Dropped,
+		TimedOut:       s.total.TimedOut,
+		AverageRunTime: s.avgRun,
+		LastShed:       s.lastShed,
+	}
+}
+
+// View returns a consistent snapshot of the status and the cumulative counters
+// of the stack. When the stack is closed, it returns the last state, with
+// Closed set.
+func (s *Stack) View() StackView {
+	var v StackView
+	if !s.call(func() { v = s.view() }) {
+		<-s.hasQuit
+		v = s.view()
+		v.Closed = true
+	}
+
+	v.PendingReleases = int(atomic.LoadInt64(&s.pendingReleases))
+	v.BlockedWaiters = int(atomic.LoadInt64(&s.blockedWaiters))
+	v.AbandonedReleases = int(atomic.LoadInt64(&s.abandonedReleases))
+	return v
+}
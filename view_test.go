@@ -0,0 +1,41 @@
+package jobqueue
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+)
+
+func TestView(t *testing.T) {
+	q := With(Options{MaxConcurrency: 4, MaxStackSize: 1})
+	defer q.CloseForced()
+
+	for i := 0; i < 2; i++ {
+		done, err := q.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			done()
+		}
+	}
+
+	tmpl := template.Must(template.New("view").Parse(
+		"{{.ActiveJobs}}/{{.MaxConcurrency}} {{printf \"%.0f\" .SaturationPct}}% {{.Scheduled}} {{.Completed}}",
+	))
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, q.View()); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.String() != "1/4 25% 2 1" {
+		t.Error("invalid view", b.String())
+	}
+
+	q.CloseForced()
+	if v := q.View(); !v.Closed || v.Scheduled != 2 {
+		t.Error("invalid view after closed", v)
+	}
+}